@@ -7,6 +7,36 @@ import (
 type Configuration struct {
 	VERSION                        string
 	JWT_SECRET                     string
+	CREDENTIALS_ENCRYPTION_KEY     string
+	JWT_KEYS                       []string
+	JWT_ACTIVE_KID                 string
+	OIDC_ISSUER                    string
+	OIDC_AUDIENCE                  string
+	OIDC_JWKS_URL                  string
+	OIDC_USER_MAPPINGS_PATH        string
+	HTTPS_CERT_PATH                string
+	HTTPS_KEY_PATH                 string
+	HTTPS_CLIENT_CA_PATH           string
+	HTTPS_REQUIRE_CLIENT_CERT      bool
+	CLIENT_CERT_MAPPINGS_PATH      string
+	SIGNATURE_VERIFIERS_PATH       string
+	RATE_LIMIT_ACCOUNT_PER_MINUTE  int
+	RATE_LIMIT_USER_PER_MINUTE     int
+	RATE_LIMIT_STATION_PER_MINUTE  int
+	RATE_LIMIT_IP_PER_MINUTE       int
+	RATE_LIMIT_SYNC_SUBJ           string
+	MAX_CACHED_CONNECTIONS         int
+	PRODUCER_IDLE_TIMEOUT_SECONDS  int
+	MAX_PRODUCERS_PER_CONNECTION   int
+	BATCH_PRODUCE_MAX_IN_FLIGHT    int
+	ASYNC_PRODUCE_WORKERS          int
+	ASYNC_PRODUCE_QUEUE_SIZE       int
+	RECEIPTS_RETENTION_SECONDS     int
+	OUTBOX_DIR                     string
+	OUTBOX_MAX_BYTES               int64
+	OUTBOX_SEGMENT_BYTES           int64
+	OUTBOX_FSYNC                   string
+	OUTBOX_FSYNC_INTERVAL_MS       int
 	JWT_EXPIRES_IN_MINUTES         int
 	REFRESH_JWT_SECRET             string
 	REFRESH_JWT_EXPIRES_IN_MINUTES int
@@ -14,6 +44,7 @@ type Configuration struct {
 	ROOT_USER                      string
 	CONNECTION_TOKEN               string
 	MEMPHIS_HOST                   string
+	MEMPHIS_PORT                   int
 	DEV_ENV                        string
 	CLIENT_CERT_PATH               string
 	CLIENT_KEY_PATH                string
@@ -23,6 +54,12 @@ type Configuration struct {
 	DEBUG                          bool
 	CLOUD_ENV                      bool
 	REST_GW_UPDATES_SUBJ           string
+	WEBHOOK_TIMEOUT_SECONDS        int
+	WEBHOOK_MAX_RETRIES            int
+	WEBHOOK_ALLOW_PRIVATE_TARGETS  bool
+	PRODUCE_CONTENT_TYPES          []string
+	CONSUME_MAX_WAIT_SECONDS       int
+	CONSUME_RETRY_AFTER_SECONDS    int
 }
 
 func GetConfig() Configuration {
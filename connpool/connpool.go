@@ -0,0 +1,353 @@
+// Package connpool caches the broker connections of the gateway users
+package connpool
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/memphisdev/memphis.go"
+)
+
+const numShards = 32
+
+// isConnected is replaced in the tests, which have no broker to connect to
+var isConnected = func(conn *memphis.Conn) bool {
+	return conn.IsConnected()
+}
+
+// Key identifies the connection of a user within an account
+type Key struct {
+	AccountId string
+	Username  string
+}
+
+type entry struct {
+	key               Key
+	conn              *memphis.Conn
+	expirationTime    int64
+	element           *list.Element
+	lastUsed          uint64    // pool wide use counter, orders the entries of all the shards
+	refs              int       // number of holders that acquired the connection
+	detached          bool      // removed from the pool, closed once the last holder releases it
+	disconnectedSince time.Time // zero while connected
+}
+
+type call struct {
+	done chan struct{}
+	conn *memphis.Conn
+	err  error
+}
+
+type shard struct {
+	lock     sync.Mutex
+	entries  map[Key]*entry
+	lru      *list.List // front is the most recently used
+	inflight map[Key]*call
+}
+
+// Pool is safe for concurrent use, the users are spread over shards so requests of different users rarely contend,
+// and concurrent requests of a user without a connection share a single connect
+type Pool struct {
+	shards            [numShards]*shard
+	maxConnections    int
+	size              atomic.Int64  // cached connections in all the shards
+	uses              atomic.Uint64 // source of the entries' lastUsed
+	evictLock         sync.Mutex    // a single caller evicts at a time so the pool does not shrink below the limit
+	disconnectedGrace time.Duration
+	onEvict           []func(Key, *memphis.Conn)
+	onEvictLock       sync.RWMutex
+}
+
+// New returns a pool holding up to maxConnections connections (unbounded when 0), the least recently used connections
+// are removed once the pool is full, and disconnected ones once they did not reconnect within disconnectedGrace
+func New(maxConnections int, disconnectedGrace time.Duration) *Pool {
+	p := &Pool{maxConnections: maxConnections, disconnectedGrace: disconnectedGrace}
+	for i := range p.shards {
+		p.shards[i] = &shard{
+			entries:  map[Key]*entry{},
+			lru:      list.New(),
+			inflight: map[Key]*call{},
+		}
+	}
+	return p
+}
+
+// OnEvict registers a callback that is called before a connection removed from the pool is closed
+func (p *Pool) OnEvict(f func(Key, *memphis.Conn)) {
+	p.onEvictLock.Lock()
+	defer p.onEvictLock.Unlock()
+	p.onEvict = append(p.onEvict, f)
+}
+
+func (p *Pool) shard(key Key) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key.AccountId))
+	h.Write([]byte{0})
+	h.Write([]byte(key.Username))
+	return p.shards[h.Sum32()%numShards]
+}
+
+// detach removes the entry from the pool, it must be called while holding the shard lock and reports whether the
+// connection can be closed right away, connections in use are closed once released by their last holder
+func (p *Pool) detach(s *shard, e *entry) bool {
+	s.lru.Remove(e.element)
+	delete(s.entries, e.key)
+	p.size.Add(-1)
+	e.detached = true
+	return e.refs == 0
+}
+
+// touch marks the entry as the most recently used one, it must be called while holding the shard lock
+func (p *Pool) touch(s *shard, e *entry) {
+	s.lru.MoveToFront(e.element)
+	e.lastUsed = p.uses.Add(1)
+}
+
+// enforceLimit removes the least recently used connections of the whole pool until it holds at most maxConnections,
+// it must be called without holding a shard lock
+func (p *Pool) enforceLimit() {
+	if p.maxConnections <= 0 {
+		return
+	}
+	p.evictLock.Lock()
+	defer p.evictLock.Unlock()
+	for p.size.Load() > int64(p.maxConnections) {
+		// the oldest entry of the pool is the oldest of one of the shards
+		var oldestShard *shard
+		var oldestUse uint64
+		for _, s := range p.shards {
+			s.lock.Lock()
+			if back := s.lru.Back(); back != nil {
+				if e := back.Value.(*entry); oldestShard == nil || e.lastUsed < oldestUse {
+					oldestShard, oldestUse = s, e.lastUsed
+				}
+			}
+			s.lock.Unlock()
+		}
+		if oldestShard == nil {
+			return
+		}
+
+		var evicted *entry
+		oldestShard.lock.Lock()
+		if back := oldestShard.lru.Back(); back != nil && back.Value.(*entry).lastUsed == oldestUse { // not used since it was found
+			if e := back.Value.(*entry); p.detach(oldestShard, e) {
+				evicted = e
+			}
+		}
+		oldestShard.lock.Unlock()
+		if evicted != nil {
+			p.evicted(evicted.key, evicted.conn)
+		}
+	}
+}
+
+// evicted closes the connection, it must be called without holding a shard lock
+func (p *Pool) evicted(key Key, conn *memphis.Conn) {
+	if conn == nil {
+		return
+	}
+	p.onEvictLock.RLock()
+	onEvict := p.onEvict
+	p.onEvictLock.RUnlock()
+	for _, f := range onEvict {
+		f(key, conn)
+	}
+	conn.Close()
+}
+
+// Get returns the cached connection of the key
+func (p *Pool) Get(key Key) (*memphis.Conn, bool) {
+	s := p.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	p.touch(s, e)
+	return e.conn, true
+}
+
+// set adds a new entry, it must be called while holding the shard lock, and enforceLimit once the lock is released
+func (p *Pool) set(s *shard, key Key, conn *memphis.Conn, expirationTime int64) *entry {
+	e := &entry{key: key, conn: conn, expirationTime: expirationTime, lastUsed: p.uses.Add(1)}
+	e.element = s.lru.PushFront(e)
+	s.entries[key] = e
+	p.size.Add(1)
+	return e
+}
+
+// Add caches the connection of the key until the expiration time (unix seconds), when a connection of the key is already
+// cached it is kept, its expiration time is extended and false is returned so the caller can close its own connection
+func (p *Pool) Add(key Key, conn *memphis.Conn, expirationTime int64) bool {
+	s := p.shard(key)
+	s.lock.Lock()
+	if e, ok := s.entries[key]; ok {
+		if expirationTime > e.expirationTime {
+			e.expirationTime = expirationTime
+		}
+		p.touch(s, e)
+		s.lock.Unlock()
+		return e.conn == conn
+	}
+	p.set(s, key, conn, expirationTime)
+	s.lock.Unlock()
+	p.enforceLimit()
+	return true
+}
+
+// GetOrConnect returns the cached connection of the key, or connects and caches the new connection,
+// the expiration time of a cached connection is extended when a later one is given.
+// The connection may be closed once it is evicted, holders that outlive a request should use Acquire
+func (p *Pool) GetOrConnect(key Key, expirationTime int64, connect func() (*memphis.Conn, error)) (*memphis.Conn, error) {
+	conn, release, err := p.Acquire(key, expirationTime, connect)
+	if err != nil {
+		return nil, err
+	}
+	release()
+	return conn, nil
+}
+
+// Acquire works like GetOrConnect but keeps the connection open until the returned release func is called,
+// even if it is evicted from the pool in the meantime
+func (p *Pool) Acquire(key Key, expirationTime int64, connect func() (*memphis.Conn, error)) (*memphis.Conn, func(), error) {
+	s := p.shard(key)
+	s.lock.Lock()
+	for {
+		if e, ok := s.entries[key]; ok {
+			p.touch(s, e)
+			if expirationTime > e.expirationTime {
+				e.expirationTime = expirationTime
+			}
+			e.refs++
+			s.lock.Unlock()
+			return e.conn, p.releaser(s, e), nil
+		}
+		c, ok := s.inflight[key]
+		if !ok {
+			break
+		}
+		s.lock.Unlock()
+		<-c.done
+		if c.err != nil {
+			return nil, nil, c.err
+		}
+		s.lock.Lock() // the new connection may have already been evicted, so it is looked up again
+	}
+	c := &call{done: make(chan struct{})}
+	s.inflight[key] = c
+	s.lock.Unlock()
+
+	c.conn, c.err = connect()
+
+	var e *entry
+	s.lock.Lock()
+	delete(s.inflight, key)
+	if c.err == nil {
+		e = p.set(s, key, c.conn, expirationTime)
+		e.refs++
+	}
+	s.lock.Unlock()
+	close(c.done)
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+	p.enforceLimit()
+	return c.conn, p.releaser(s, e), nil
+}
+
+func (p *Pool) releaser(s *shard, e *entry) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.lock.Lock()
+			e.refs--
+			closeConn := e.detached && e.refs == 0
+			s.lock.Unlock()
+			if closeConn {
+				p.evicted(e.key, e.conn)
+			}
+		})
+	}
+}
+
+// Remove removes the connection of the key and closes it right away, even if it is in use (e.g. once the user is revoked)
+func (p *Pool) Remove(key Key) {
+	s := p.shard(key)
+	s.lock.Lock()
+	e, ok := s.entries[key]
+	if ok {
+		p.detach(s, e)
+		e.refs = 0 // releasing it later must not close it again
+	}
+	s.lock.Unlock()
+	if ok {
+		p.evicted(key, e.conn)
+	}
+}
+
+// Contains reports whether a connection of the key is cached
+func (p *Pool) Contains(key Key) bool {
+	s := p.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.entries[key]
+	return ok
+}
+
+// Len returns the number of cached connections
+func (p *Pool) Len() int {
+	count := 0
+	for _, s := range p.shards {
+		s.lock.Lock()
+		count += len(s.entries)
+		s.lock.Unlock()
+	}
+	return count
+}
+
+// Keys returns the keys of the cached connections
+func (p *Pool) Keys() []Key {
+	keys := []Key{}
+	for _, s := range p.shards {
+		s.lock.Lock()
+		for key := range s.entries {
+			keys = append(keys, key)
+		}
+		s.lock.Unlock()
+	}
+	return keys
+}
+
+// CleanExpired removes the connections that expired or stayed disconnected for longer than the grace period,
+// connections that are still reconnecting are kept
+func (p *Pool) CleanExpired(now time.Time) {
+	for _, s := range p.shards {
+		evicted := []*entry{}
+		s.lock.Lock()
+		for _, e := range s.entries {
+			disconnected := false
+			if e.conn != nil && !isConnected(e.conn) {
+				if e.disconnectedSince.IsZero() {
+					e.disconnectedSince = now
+				}
+				disconnected = now.Sub(e.disconnectedSince) > p.disconnectedGrace
+			} else {
+				e.disconnectedSince = time.Time{}
+			}
+			if disconnected || now.Unix() > e.expirationTime {
+				if p.detach(s, e) {
+					evicted = append(evicted, e)
+				}
+			}
+		}
+		s.lock.Unlock()
+		for _, e := range evicted {
+			p.evicted(e.key, e.conn)
+		}
+	}
+}
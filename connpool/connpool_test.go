@@ -0,0 +1,343 @@
+package connpool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/memphisdev/memphis.go"
+)
+
+// the tests use connections that were never connected, closing them is a no-op and they are reported as connected
+// unless a test replaces isConnected
+func newConn() *memphis.Conn {
+	return &memphis.Conn{}
+}
+
+func TestMain(m *testing.M) {
+	isConnected = func(*memphis.Conn) bool { return true }
+	os.Exit(m.Run())
+}
+
+type evictions struct {
+	lock  sync.Mutex
+	conns map[*memphis.Conn]int
+}
+
+func trackEvictions(p *Pool) *evictions {
+	ev := &evictions{conns: map[*memphis.Conn]int{}}
+	p.OnEvict(func(_ Key, conn *memphis.Conn) {
+		ev.lock.Lock()
+		ev.conns[conn]++
+		ev.lock.Unlock()
+	})
+	return ev
+}
+
+func (ev *evictions) count(conn *memphis.Conn) int {
+	ev.lock.Lock()
+	defer ev.lock.Unlock()
+	return ev.conns[conn]
+}
+
+func (ev *evictions) total() int {
+	ev.lock.Lock()
+	defer ev.lock.Unlock()
+	total := 0
+	for _, count := range ev.conns {
+		total += count
+	}
+	return total
+}
+
+func TestGetOrConnectSingleFlight(t *testing.T) {
+	p := New(0, time.Minute)
+	key := Key{AccountId: "1", Username: "user"}
+	var connects atomic.Int32
+	release := make(chan struct{})
+	connect := func() (*memphis.Conn, error) {
+		connects.Add(1)
+		<-release
+		return newConn(), nil
+	}
+
+	const callers = 50
+	conns := make([]*memphis.Conn, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := p.GetOrConnect(key, time.Now().Add(time.Hour).Unix(), connect)
+			if err != nil {
+				t.Errorf("GetOrConnect: %v", err)
+			}
+			conns[i] = conn
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := connects.Load(); n != 1 {
+		t.Fatalf("expected a single connect, got %d", n)
+	}
+	for i, conn := range conns {
+		if conn != conns[0] {
+			t.Fatalf("caller %d got a different connection", i)
+		}
+	}
+	if p.Len() != 1 {
+		t.Fatalf("expected 1 cached connection, got %d", p.Len())
+	}
+}
+
+func TestGetOrConnectError(t *testing.T) {
+	p := New(0, time.Minute)
+	key := Key{AccountId: "1", Username: "user"}
+	connectErr := errors.New("authorization violation")
+	var connects atomic.Int32
+	release := make(chan struct{})
+	connect := func() (*memphis.Conn, error) {
+		connects.Add(1)
+		<-release
+		return nil, connectErr
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.GetOrConnect(key, time.Now().Add(time.Hour).Unix(), connect); !errors.Is(err, connectErr) {
+				t.Errorf("expected the connect error, got %v", err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := connects.Load(); n != 1 {
+		t.Fatalf("expected a single connect, got %d", n)
+	}
+	if p.Contains(key) {
+		t.Fatal("a failed connect must not be cached")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	const maxConnections = 10
+	p := New(maxConnections, time.Minute)
+	ev := trackEvictions(p)
+	expiration := time.Now().Add(time.Hour).Unix()
+
+	conns := map[Key]*memphis.Conn{}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for i := 0; i < 500; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := Key{AccountId: "1", Username: fmt.Sprintf("user%d", i)}
+			conn := newConn()
+			lock.Lock()
+			conns[key] = conn
+			lock.Unlock()
+			p.Add(key, conn, expiration)
+		}(i)
+	}
+	wg.Wait()
+
+	if p.Len() != maxConnections {
+		t.Fatalf("expected %d cached connections, got %d", maxConnections, p.Len())
+	}
+	if ev.total() != len(conns)-p.Len() {
+		t.Fatalf("expected %d evicted connections, got %d", len(conns)-p.Len(), ev.total())
+	}
+	for key, conn := range conns {
+		cached := p.Contains(key)
+		if evicted := ev.count(conn); (evicted == 1) == cached || evicted > 1 {
+			t.Fatalf("connection of %v cached %v but evicted %d times", key, cached, evicted)
+		}
+	}
+}
+
+func TestNoEvictionBelowLimit(t *testing.T) {
+	const maxConnections = 100
+	p := New(maxConnections, time.Minute)
+	ev := trackEvictions(p)
+	expiration := time.Now().Add(time.Hour).Unix()
+
+	// the keys are spread unevenly over the shards, the limit applies to the whole pool
+	for i := 0; i < maxConnections; i++ {
+		p.Add(Key{AccountId: "1", Username: fmt.Sprintf("user%d", i)}, newConn(), expiration)
+	}
+	if p.Len() != maxConnections || ev.total() != 0 {
+		t.Fatalf("expected no eviction below the limit, %d cached and %d evicted", p.Len(), ev.total())
+	}
+	p.Add(Key{AccountId: "1", Username: "one-more"}, newConn(), expiration)
+	if p.Len() != maxConnections || ev.total() != 1 || p.Contains(Key{AccountId: "1", Username: "user0"}) {
+		t.Fatalf("expected only the least recently used connection to be evicted, %d cached and %d evicted", p.Len(), ev.total())
+	}
+}
+
+func TestEvictionLeastRecentlyUsed(t *testing.T) {
+	p := New(2, time.Minute)
+	ev := trackEvictions(p)
+	expiration := time.Now().Add(time.Hour).Unix()
+
+	keys := []Key{}
+	for i := 0; i < 3; i++ {
+		keys = append(keys, Key{AccountId: "1", Username: fmt.Sprintf("user%d", i)})
+	}
+	oldest, recent := newConn(), newConn()
+	p.Add(keys[0], oldest, expiration)
+	p.Add(keys[1], recent, expiration)
+	p.Get(keys[0]) // keys[1] becomes the least recently used
+	p.Add(keys[2], newConn(), expiration)
+
+	if !p.Contains(keys[0]) || p.Contains(keys[1]) || !p.Contains(keys[2]) {
+		t.Fatalf("expected the least recently used connection to be evicted, cached keys: %v", p.Keys())
+	}
+	if ev.count(recent) != 1 || ev.count(oldest) != 0 {
+		t.Fatal("expected only the least recently used connection to be closed")
+	}
+}
+
+func TestEvictionKeepsAcquiredConnectionOpen(t *testing.T) {
+	p := New(1, time.Minute)
+	ev := trackEvictions(p)
+	expiration := time.Now().Add(time.Hour).Unix()
+
+	keys := []Key{{AccountId: "1", Username: "user0"}, {AccountId: "1", Username: "user1"}}
+	inUse := newConn()
+	conn, release, err := p.Acquire(keys[0], expiration, func() (*memphis.Conn, error) { return inUse, nil })
+	if err != nil || conn != inUse {
+		t.Fatalf("Acquire: %v", err)
+	}
+	p.Add(keys[1], newConn(), expiration)
+
+	if p.Contains(keys[0]) {
+		t.Fatal("expected the acquired connection to be evicted from the pool")
+	}
+	if ev.count(inUse) != 0 {
+		t.Fatal("an acquired connection must not be closed while in use")
+	}
+	release()
+	release() // releasing twice must not close it twice
+	if ev.count(inUse) != 1 {
+		t.Fatalf("expected the connection to be closed once released, closed %d times", ev.count(inUse))
+	}
+}
+
+func TestRemoveClosesAcquiredConnection(t *testing.T) {
+	p := New(0, time.Minute)
+	ev := trackEvictions(p)
+	key := Key{AccountId: "1", Username: "user"}
+	conn, release, err := p.Acquire(key, time.Now().Add(time.Hour).Unix(), func() (*memphis.Conn, error) { return newConn(), nil })
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	p.Remove(key)
+	if ev.count(conn) != 1 {
+		t.Fatal("expected a removed connection to be closed right away")
+	}
+	release()
+	if ev.count(conn) != 1 {
+		t.Fatal("expected a removed connection not to be closed again once released")
+	}
+}
+
+func TestCleanExpired(t *testing.T) {
+	p := New(0, time.Minute)
+	ev := trackEvictions(p)
+	now := time.Now()
+	expired, valid := Key{AccountId: "1", Username: "expired"}, Key{AccountId: "1", Username: "valid"}
+	expiredConn := newConn()
+	p.Add(expired, expiredConn, now.Add(-time.Second).Unix())
+	p.Add(valid, newConn(), now.Add(time.Hour).Unix())
+
+	p.CleanExpired(now)
+	if p.Contains(expired) || !p.Contains(valid) {
+		t.Fatalf("expected only the expired connection to be removed, cached keys: %v", p.Keys())
+	}
+	if ev.count(expiredConn) != 1 {
+		t.Fatal("expected the expired connection to be closed")
+	}
+}
+
+func TestCleanExpiredKeepsReconnectingConnections(t *testing.T) {
+	grace := time.Minute
+	p := New(0, grace)
+	ev := trackEvictions(p)
+	now := time.Now()
+	key := Key{AccountId: "1", Username: "user"}
+	conn := newConn()
+	p.Add(key, conn, now.Add(time.Hour).Unix())
+
+	var connected atomic.Bool
+	restore := isConnected
+	isConnected = func(*memphis.Conn) bool { return connected.Load() }
+	defer func() { isConnected = restore }()
+
+	p.CleanExpired(now)
+	p.CleanExpired(now.Add(grace / 2))
+	if !p.Contains(key) {
+		t.Fatal("a connection that is still reconnecting must be kept")
+	}
+
+	// reconnecting resets the grace period
+	connected.Store(true)
+	p.CleanExpired(now.Add(grace - time.Second))
+	connected.Store(false)
+	p.CleanExpired(now.Add(grace + time.Second))
+	if !p.Contains(key) {
+		t.Fatal("the grace period should start over once the connection reconnected")
+	}
+
+	p.CleanExpired(now.Add(3 * grace))
+	if p.Contains(key) || ev.count(conn) != 1 {
+		t.Fatal("expected a connection that stayed disconnected past the grace period to be closed")
+	}
+}
+
+func TestAcquireConcurrentWithEviction(t *testing.T) {
+	p := New(5, time.Minute)
+	ev := trackEvictions(p)
+	expiration := time.Now().Add(time.Hour).Unix()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := Key{AccountId: "1", Username: fmt.Sprintf("user%d", i%20)}
+			conn, release, err := p.Acquire(key, expiration, func() (*memphis.Conn, error) { return newConn(), nil })
+			if err != nil {
+				t.Errorf("Acquire: %v", err)
+				return
+			}
+			if ev.count(conn) != 0 {
+				t.Errorf("connection of %v was closed while in use", key)
+			}
+			release()
+		}(i)
+	}
+	wg.Wait()
+	p.CleanExpired(time.Unix(expiration+1, 0))
+	if p.Len() != 0 {
+		t.Fatalf("expected all connections to expire, %d left", p.Len())
+	}
+	ev.lock.Lock()
+	defer ev.lock.Unlock()
+	for conn, count := range ev.conns {
+		if count != 1 {
+			t.Fatalf("connection %p closed %d times", conn, count)
+		}
+	}
+}
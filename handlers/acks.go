@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"rest-gateway/logger"
+	"rest-gateway/models"
+	"rest-gateway/utils"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/memphisdev/memphis.go"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	defaultAckDeadlineMs        = 30000
+	defaultManualAckMaxDelivery = 10
+	manualAckSuffix             = "manual-ack"
+)
+
+type ackRequestBody struct {
+	AckTokens []string `json:"ack_tokens"`
+}
+
+// ackToken is sealed with the credentials key and carries the subject the broker expects the message's ack on,
+// so the message can be settled through any gateway, also after the gateway that fetched it restarted
+type ackToken struct {
+	Reply       string `json:"reply"`
+	StationName string `json:"station_name"`
+	AccountId   string `json:"account_id"`
+	Username    string `json:"username"`
+	Deadline    int64  `json:"deadline"` // unix milliseconds
+}
+
+func generateRandomId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// msgReplySubject returns the ack subject of a fetched message, which the sdk keeps in an unexported field
+func msgReplySubject(msg *memphis.Msg) (string, error) {
+	field := reflect.ValueOf(msg).Elem().FieldByName("msg")
+	if !field.IsValid() {
+		return "", errors.New("the message does not carry an ack subject")
+	}
+	switch m := reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface().(type) {
+	case *nats.Msg:
+		return m.Reply, nil
+	case jetstream.Msg:
+		return m.Reply(), nil
+	}
+	return "", errors.New("message format is not supported")
+}
+
+func sealAckToken(msg *memphis.Msg, stationName, accountId, username string, ackDeadline time.Duration) (string, error) {
+	reply, err := msgReplySubject(msg)
+	if err != nil {
+		return "", err
+	}
+	if reply == "" {
+		return "", errors.New("the message does not carry an ack subject")
+	}
+	plaintext, err := json.Marshal(ackToken{
+		Reply:       reply,
+		StationName: strings.ToLower(stationName),
+		AccountId:   accountId,
+		Username:    username,
+		Deadline:    time.Now().Add(ackDeadline).UnixMilli(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return utils.Encrypt(credentialsKey(), plaintext)
+}
+
+// openAckToken returns the ack subject sealed into the token once it is checked to belong to the station and the user
+func openAckToken(token, stationName, accountId, username string) (string, error) {
+	plaintext, err := utils.Decrypt(credentialsKey(), token)
+	if err != nil {
+		return "", fmt.Errorf("ack token %s is invalid", token)
+	}
+	var opened ackToken
+	if err := json.Unmarshal(plaintext, &opened); err != nil {
+		return "", fmt.Errorf("ack token %s is invalid", token)
+	}
+	if opened.StationName != strings.ToLower(stationName) || opened.AccountId != accountId || opened.Username != username {
+		return "", fmt.Errorf("ack token %s does not belong to this station", token)
+	}
+	if time.Now().UnixMilli() > opened.Deadline {
+		return "", fmt.Errorf("the ack deadline of ack token %s has passed", token)
+	}
+	return opened.Reply, nil
+}
+
+// settleMessage acks or nacks a message over the user's own broker connection, as it is published to the user's account
+func settleMessage(nc *userNatsConn, reply, action string) error {
+	if action == "ack" {
+		return nc.nc.Publish(reply, []byte("+ACK"))
+	}
+	return nc.nc.Publish(reply, []byte("-NAK"))
+}
+
+func settleHandleMessages(action string) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		log := logger.GetLogger(c)
+		// We do this parse to params instead of use fiber because there is a memory leak error in fiber
+		stationName := StationName(c)
+		reqBody := ackRequestBody{}
+		if err := c.BodyParser(&reqBody); err != nil {
+			log.Errorf("SettleHandleMessages - parse request body: %s", err.Error())
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "Invalid request body",
+			})
+		}
+		if len(reqBody.AckTokens) == 0 {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "ack_tokens is required",
+			})
+		}
+		userData, ok := c.Locals("userData").(models.AuthSchema)
+		if !ok {
+			log.Errorf("SettleHandleMessages: failed to get the user data from the middleware")
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "Server error",
+			})
+		}
+		accountIdStr := strconv.Itoa(int(userData.AccountId))
+		nc, release, err := getUserNatsConn(userData)
+		if err != nil {
+			if isAuthError(err) {
+				log.Warnf("Could not establish new connection with the broker: Authentication error")
+				return c.Status(401).JSON(fiber.Map{
+					"message": "Unauthorized",
+				})
+			}
+
+			log.Errorf("Could not establish new connection with the broker: %s", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"message": "Server error",
+			})
+		}
+		defer release()
+
+		errCount := 0
+		var allErr []string
+		for _, token := range reqBody.AckTokens {
+			reply, err := openAckToken(token, stationName, accountIdStr, userData.Username)
+			if err == nil {
+				err = settleMessage(nc, reply, action)
+			}
+			if err != nil {
+				errCount++
+				allErr = append(allErr, err.Error())
+			}
+		}
+		if err := nc.nc.Flush(); err != nil {
+			log.Errorf("SettleHandleMessages - %s messages: %s", action, err.Error())
+			c.Status(fiber.StatusServiceUnavailable)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		if errCount > 0 {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				action:    len(reqBody.AckTokens) - errCount,
+				"fail":    errCount,
+				"errors":  allErr,
+			})
+		}
+
+		c.Status(fiber.StatusOK)
+		return c.JSON(&fiber.Map{
+			"success": true,
+			"error":   nil,
+		})
+	}
+}
+
+func AckHandleMessages() func(*fiber.Ctx) error {
+	return settleHandleMessages("ack")
+}
+
+func NackHandleMessages() func(*fiber.Ctx) error {
+	return settleHandleMessages("nack")
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"rest-gateway/logger"
+	"rest-gateway/memphisSingleton"
+	"rest-gateway/models"
+	"rest-gateway/utils"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/nats-io/nats.go"
+)
+
+type ApiKeysHandler struct{}
+
+const apiKeysBucket = "rest_gw_api_keys"
+const apiKeyPrefix = "mgw_"
+
+// the keys are persisted hashed in a bucket for gateways that start later, and broadcast over the updates subject
+// so every running gateway accepts or rejects a key as soon as it is created or revoked
+var apiKeys = map[string]models.ApiKey{} // by key hash
+var apiKeysLock sync.RWMutex
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func publicApiKey(apiKey models.ApiKey) models.ApiKey {
+	apiKey.KeyHash = ""
+	apiKey.Credentials = ""
+	return apiKey
+}
+
+func setApiKey(apiKey models.ApiKey) {
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	apiKeys[apiKey.KeyHash] = apiKey
+}
+
+func removeApiKey(id string) {
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	for hash, apiKey := range apiKeys {
+		if apiKey.Id == id {
+			delete(apiKeys, hash)
+		}
+	}
+}
+
+// LoadApiKeys loads the keys created by any of the gateways so far
+func LoadApiKeys() error {
+	kv, err := memphisSingleton.GetKeyValueStore(apiKeysBucket)
+	if err != nil {
+		return err
+	}
+	keys, err := kv.Keys()
+	if err != nil {
+		if errors.Is(err, nats.ErrNoKeysFound) {
+			return nil
+		}
+		return err
+	}
+	for _, id := range keys {
+		entry, err := kv.Get(id)
+		if err != nil {
+			if errors.Is(err, nats.ErrKeyNotFound) {
+				continue
+			}
+			return err
+		}
+		var apiKey models.ApiKey
+		if err := json.Unmarshal(entry.Value(), &apiKey); err != nil {
+			return err
+		}
+		setApiKey(apiKey)
+	}
+	return nil
+}
+
+// VerifyApiKey returns the user the api key is bound to
+func VerifyApiKey(key string) (models.AuthSchema, error) {
+	hash := hashApiKey(key)
+	apiKeysLock.RLock()
+	apiKey, ok := apiKeys[hash]
+	apiKeysLock.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(hash)) != 1 {
+		return models.AuthSchema{}, errors.New("unknown api key")
+	}
+
+	// the cached connection is renewed periodically, like it is for jwt based users
+	expiry := time.Now().Add(time.Duration(configuration.JWT_EXPIRES_IN_MINUTES) * time.Minute)
+	if apiKey.ExpiresAt != nil {
+		if time.Now().After(*apiKey.ExpiresAt) {
+			return models.AuthSchema{}, errors.New("api key expired")
+		}
+		if apiKey.ExpiresAt.Before(expiry) {
+			expiry = *apiKey.ExpiresAt
+		}
+	}
+	password, connectionToken, err := OpenCredentials(apiKey.Credentials)
+	if err != nil {
+		return models.AuthSchema{}, err
+	}
+	user := models.AuthSchema{
+		Username:        apiKey.Username,
+		Password:        password,
+		ConnectionToken: connectionToken,
+		AccountId:       apiKey.AccountId,
+		TokenExpiry:     expiry.Unix(),
+		Scopes:          apiKey.Scopes,
+		TokenIssuedAt:   apiKey.CreatedAt.Unix(), // keys created before the user was revoked are rejected
+	}
+	if apiKey.ExpiresAt != nil {
+		user.CredentialsExpiry = apiKey.ExpiresAt.Unix()
+	}
+	return user, nil
+}
+
+func publishApiKeyUpdate(updateType string, update map[string]interface{}) error {
+	mc, err := memphisSingleton.GetMemphisConnection("", "", "") // already initialized on logger creation
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(models.RestGwUpdate{Type: updateType, Update: update})
+	if err != nil {
+		return err
+	}
+	return mc.Publish(configuration.REST_GW_UPDATES_SUBJ, msg)
+}
+
+func handleApiKeyUpdate(log *logger.Logger, update models.RestGwUpdate) {
+	switch update.Type {
+	case "create_api_key":
+		apiKeyBytes, err := json.Marshal(update.Update["api_key"])
+		if err != nil {
+			log.Errorf("ListenForUpdates - api key: %s", err.Error())
+			return
+		}
+		var apiKey models.ApiKey
+		if err := json.Unmarshal(apiKeyBytes, &apiKey); err != nil {
+			log.Errorf("ListenForUpdates - api key: %s", err.Error())
+			return
+		}
+		setApiKey(apiKey)
+	case "revoke_api_key":
+		id, _ := update.Update["id"].(string)
+		removeApiKey(id)
+	}
+}
+
+func (kh ApiKeysHandler) CreateApiKey(c *fiber.Ctx) error {
+	log := logger.GetLogger(c)
+	var body models.CreateApiKeySchema
+	if err := c.BodyParser(&body); err != nil {
+		log.Warnf("CreateApiKey: %s", err.Error())
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"message": "Invalid request body",
+		})
+	}
+	if err := utils.Validate(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"message": err,
+		})
+	}
+	if err := validateScopes(body.Scopes); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"message": err.Error(),
+		})
+	}
+	if body.ExpiresInMinutes < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"message": "expires_in_minutes should be a positive number",
+		})
+	}
+	if body.AccountId == 0 {
+		body.AccountId = 1
+	}
+	body.Username = strings.ToLower(body.Username)
+
+	// make sure the key is bound to valid credentials
+	conn, err := Connect(body.Password, body.Username, body.ConnectionToken, int(body.AccountId))
+	if err != nil {
+		if isAuthError(err) {
+			log.Warnf("CreateApiKey: Authentication error")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"message": "Invalid broker credentials",
+			})
+		}
+		log.Errorf("CreateApiKey: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	conn.Close()
+
+	id, err := generateRandomId()
+	if err != nil {
+		log.Errorf("CreateApiKey: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	secret, err := generateRandomId()
+	if err != nil {
+		log.Errorf("CreateApiKey: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	credentials, err := sealCredentials(body.Password, body.ConnectionToken)
+	if err != nil {
+		log.Errorf("CreateApiKey: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	key := apiKeyPrefix + id + secret
+	apiKey := models.ApiKey{
+		Id:          id,
+		Name:        body.Name,
+		Username:    body.Username,
+		AccountId:   body.AccountId,
+		Scopes:      body.Scopes,
+		KeyHash:     hashApiKey(key),
+		Credentials: credentials,
+		CreatedAt:   time.Now(),
+	}
+	if body.ExpiresInMinutes > 0 {
+		expiresAt := apiKey.CreatedAt.Add(time.Duration(body.ExpiresInMinutes) * time.Minute)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	kv, err := memphisSingleton.GetKeyValueStore(apiKeysBucket)
+	if err == nil {
+		var apiKeyBytes []byte
+		apiKeyBytes, err = json.Marshal(apiKey)
+		if err == nil {
+			_, err = kv.Put(id, apiKeyBytes)
+		}
+	}
+	if err != nil {
+		log.Errorf("CreateApiKey: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	setApiKey(apiKey)
+	if err := publishApiKeyUpdate("create_api_key", map[string]interface{}{"api_key": apiKey}); err != nil {
+		log.Errorf("CreateApiKey: %s", err.Error())
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"api_key": key, // the key is only returned once, on creation
+		"key":     publicApiKey(apiKey),
+	})
+}
+
+func (kh ApiKeysHandler) ListApiKeys(c *fiber.Ctx) error {
+	apiKeysLock.RLock()
+	res := []models.ApiKey{}
+	for _, apiKey := range apiKeys {
+		res = append(res, publicApiKey(apiKey))
+	}
+	apiKeysLock.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return c.Status(fiber.StatusOK).JSON(res)
+}
+
+func (kh ApiKeysHandler) RevokeApiKey(c *fiber.Ctx) error {
+	log := logger.GetLogger(c)
+	id := c.Params("id")
+	kv, err := memphisSingleton.GetKeyValueStore(apiKeysBucket)
+	if err != nil {
+		log.Errorf("RevokeApiKey: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	if _, err := kv.Get(id); err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"message": "API key not found",
+			})
+		}
+		log.Errorf("RevokeApiKey: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	if err := kv.Delete(id); err != nil {
+		log.Errorf("RevokeApiKey: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	removeApiKey(id)
+	if err := publishApiKeyUpdate("revoke_api_key", map[string]interface{}{"id": id}); err != nil {
+		log.Errorf("RevokeApiKey: %s", err.Error())
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
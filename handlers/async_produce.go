@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"rest-gateway/logger"
+	"rest-gateway/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/memphisdev/memphis.go"
+)
+
+const (
+	receiptPending   = "pending"
+	receiptDelivered = "delivered"
+	receiptFailed    = "failed"
+)
+
+type asyncProduceJob struct {
+	receiptId    string
+	userData     models.AuthSchema
+	stationName  string
+	producerName string
+	messages     []batchMessage
+}
+
+var errAsyncProduceQueueFull = errors.New("the gateway is busy, please retry later")
+
+// receipts are held in memory by the gateway that accepted the messages, so they can only be looked up against
+// the same gateway instance and are lost when it restarts, they are not shared between replicas
+var receipts = map[string]*models.Receipt{}
+var receiptsLock sync.Mutex
+var asyncProduceQueue chan asyncProduceJob
+
+type ReceiptsHandler struct{}
+
+// StartAsyncProduceWorkers starts the workers producing the messages accepted with async=true, every worker takes the next
+// queued job whatever its user and station, and produces its messages like a batch with up to BATCH_PRODUCE_MAX_IN_FLIGHT in flight
+func StartAsyncProduceWorkers(log *logger.Logger) {
+	workers := configuration.ASYNC_PRODUCE_WORKERS
+	if workers <= 0 {
+		workers = 1
+	}
+	queueSize := configuration.ASYNC_PRODUCE_QUEUE_SIZE
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	asyncProduceQueue = make(chan asyncProduceJob, queueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range asyncProduceQueue {
+				runAsyncProduceJob(log, job)
+			}
+		}()
+	}
+}
+
+// resolveProduceOpts applies the produce options of a message and returns the headers and partition key they set,
+// the headers are copied out of the request buffers, which are reused once the handler returns
+func resolveProduceOpts(opts []memphis.ProduceOpt) (memphis.Headers, string, error) {
+	produceOpts := memphis.ProduceOpts{MsgHeaders: memphis.Headers{MsgHeaders: map[string][]string{}}}
+	for _, opt := range opts {
+		if err := opt(&produceOpts); err != nil {
+			return memphis.Headers{}, "", err
+		}
+	}
+	hdrs := memphis.Headers{}
+	hdrs.New()
+	for key, values := range produceOpts.MsgHeaders.MsgHeaders {
+		cloned := make([]string, len(values))
+		for i, value := range values {
+			cloned[i] = strings.Clone(value)
+		}
+		hdrs.MsgHeaders[strings.Clone(key)] = cloned
+	}
+	return hdrs, strings.Clone(produceOpts.ProducerPartitionKey), nil
+}
+
+// detachMessage copies the message out of the request buffers
+func detachMessage(msg batchMessage) (batchMessage, error) {
+	hdrs, partitionKey, err := resolveProduceOpts(msg.opts)
+	if err != nil {
+		return batchMessage{}, err
+	}
+	opts := []memphis.ProduceOpt{memphis.MsgHeaders(hdrs)}
+	if partitionKey != "" {
+		opts = append(opts, memphis.ProducerPartitionKey(partitionKey))
+	}
+	return batchMessage{payload: bytes.Clone(msg.payload), msgId: strings.Clone(msg.msgId), opts: opts}, nil
+}
+
+// enqueueAsyncProduce creates a pending receipt for the messages and queues them for the workers,
+// messages which could not be parsed are recorded as failed on the receipt
+func enqueueAsyncProduce(userData models.AuthSchema, stationName, producerName string, messages []batchMessage, parseErrors []string) (string, error) {
+	if asyncProduceQueue == nil {
+		return "", errors.New("async produce is not available")
+	}
+	job := asyncProduceJob{
+		userData:     detachUserData(userData),
+		stationName:  strings.Clone(stationName),
+		producerName: producerName,
+	}
+	errs := append([]string{}, parseErrors...)
+	for _, msg := range messages {
+		detached, err := detachMessage(msg)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		detached.index = len(job.messages)
+		job.messages = append(job.messages, detached)
+	}
+	receiptId, err := generateRandomId()
+	if err != nil {
+		return "", err
+	}
+	job.receiptId = receiptId
+	receipt := &models.Receipt{
+		Id:          receiptId,
+		StationName: job.stationName,
+		Status:      receiptPending,
+		Messages:    len(job.messages) + len(errs),
+		Failed:      len(errs),
+		Errors:      errs,
+		Username:    userData.Username,
+		AccountId:   userData.AccountId,
+		CreatedAt:   time.Now(),
+	}
+	receiptsLock.Lock()
+	receipts[receiptId] = receipt
+	receiptsLock.Unlock()
+	if len(job.messages) == 0 {
+		completeReceipt(receiptId, 0, nil, false)
+		return receiptId, nil
+	}
+
+	select {
+	case asyncProduceQueue <- job:
+		return receiptId, nil
+	default:
+		receiptsLock.Lock()
+		delete(receipts, receiptId)
+		receiptsLock.Unlock()
+		return "", errAsyncProduceQueueFull
+	}
+}
+
+// detachUserData copies the user data out of the request buffers
+func detachUserData(userData models.AuthSchema) models.AuthSchema {
+	userData.Username = strings.Clone(userData.Username)
+	userData.Password = strings.Clone(userData.Password)
+	userData.ConnectionToken = strings.Clone(userData.ConnectionToken)
+	return userData
+}
+
+// runAsyncProduceJob resolves the user's connection when the job runs, since the connection the request was served with
+// may have been evicted or closed by a revocation while the job was queued, the messages are only counted as delivered
+// once the broker acknowledged them
+func runAsyncProduceJob(log *logger.Logger, job asyncProduceJob) {
+	delivered := 0
+	errs := []string{}
+	schemaValidationFailed := false
+	conn, release, err := getUserConnection(job.userData)
+	if err != nil {
+		log.Errorf("AsyncProduce - could not establish new connection with the broker: %s", err.Error())
+		for range job.messages {
+			errs = append(errs, err.Error())
+		}
+		completeReceipt(job.receiptId, delivered, errs, schemaValidationFailed)
+		return
+	}
+	defer release()
+	results := make([]batchResult, len(job.messages))
+	produceBatch(log, conn, job.stationName, job.producerName, job.messages, results)
+	for _, result := range results {
+		switch result.Status {
+		case batchResultOk:
+			delivered++
+		case batchResultSchemaError:
+			schemaValidationFailed = true
+			errs = append(errs, result.Error)
+		default:
+			errs = append(errs, result.Error)
+		}
+	}
+	completeReceipt(job.receiptId, delivered, errs, schemaValidationFailed)
+}
+
+func completeReceipt(receiptId string, delivered int, errs []string, schemaValidationFailed bool) {
+	receiptsLock.Lock()
+	defer receiptsLock.Unlock()
+	receipt, ok := receipts[receiptId]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	receipt.Delivered = delivered
+	receipt.Failed += len(errs)
+	receipt.Errors = append(append([]string{}, receipt.Errors...), errs...)
+	receipt.SchemaValidationFailed = schemaValidationFailed
+	receipt.CompletedAt = &now
+	receipt.Status = receiptDelivered
+	if receipt.Failed > 0 {
+		receipt.Status = receiptFailed
+	}
+}
+
+// respondAsync queues the messages and answers with 202 Accepted and the receipt id to look the delivery status up with
+func respondAsync(c *fiber.Ctx, userData models.AuthSchema, stationName, producerName string, messages []batchMessage, parseErrors []string) error {
+	log := logger.GetLogger(c)
+	receiptId, err := enqueueAsyncProduce(userData, stationName, producerName, messages, parseErrors)
+	if err != nil {
+		if errors.Is(err, errAsyncProduceQueueFull) {
+			log.Warnf("AsyncProduce: %s", err.Error())
+			setRetryAfter(c)
+			c.Status(fiber.StatusServiceUnavailable)
+		} else {
+			log.Errorf("AsyncProduce: %s", err.Error())
+			c.Status(fiber.StatusInternalServerError)
+		}
+		return c.JSON(&fiber.Map{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+	c.Status(fiber.StatusAccepted)
+	return c.JSON(&fiber.Map{
+		"success":    true,
+		"error":      nil,
+		"receipt_id": receiptId,
+	})
+}
+
+func (rh ReceiptsHandler) GetReceipt(c *fiber.Ctx) error {
+	log := logger.GetLogger(c)
+	url := c.Request().URI().String()
+	urlParts := strings.Split(strings.Split(url, "?")[0], "/")
+	id := urlParts[4]
+	userData, ok := c.Locals("userData").(models.AuthSchema)
+	if !ok {
+		log.Errorf("GetReceipt: failed to get the user data from the middleware")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	receiptsLock.Lock()
+	receipt, ok := receipts[id]
+	var res models.Receipt
+	if ok {
+		res = *receipt
+	}
+	receiptsLock.Unlock()
+	if !ok || res.AccountId != userData.AccountId || !strings.EqualFold(res.Username, userData.Username) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"message": "Receipt not found",
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(res)
+}
+
+func CleanReceipts() {
+	for range time.Tick(time.Second * 30) {
+		retention := time.Duration(configuration.RECEIPTS_RETENTION_SECONDS) * time.Second
+		now := time.Now()
+		receiptsLock.Lock()
+		for id, receipt := range receipts {
+			if receipt.CompletedAt != nil && now.Sub(*receipt.CompletedAt) > retention {
+				delete(receipts, id)
+			}
+		}
+		receiptsLock.Unlock()
+	}
+}
@@ -2,15 +2,16 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"rest-gateway/conf"
+	"rest-gateway/connpool"
 	"rest-gateway/logger"
 	"rest-gateway/memphisSingleton"
 	"rest-gateway/models"
 	"rest-gateway/utils"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -20,7 +21,6 @@ import (
 )
 
 var configuration = conf.GetConfig()
-var ConnectionsCacheLock sync.Mutex
 
 const (
 	ErrorMsgAuthorizationViolation = "authorization violation"
@@ -29,17 +29,32 @@ const (
 
 type AuthHandler struct{}
 
-type Connection struct {
-	Connection     *memphis.Conn `json:"connection"`
-	ExpirationTime int64         `json:"expiration_time"`
-}
-
 type refreshTokenExpiration struct {
 	TokenExpiration        int64 `json:"token_expiration"`
 	RefreshTokenExpiration int64 `json:"refresh_token_expiration"`
 }
 
-var ConnectionsCache = map[string]map[string]Connection{}
+const (
+	maxReconnects      = 10
+	reconnectInterval  = 3 * time.Second
+	defaultMemphisPort = 6666
+)
+
+// Connections caches a broker connection per user, shared by all the requests made on behalf of the user,
+// a disconnected connection is kept while the sdk may still reconnect it
+var Connections = connpool.New(configuration.MAX_CACHED_CONNECTIONS, maxReconnects*reconnectInterval)
+
+// ConnectionKey returns the key of the user's connection in the connections pool
+func ConnectionKey(accountId int, username string) connpool.Key {
+	return connpool.Key{AccountId: strconv.Itoa(accountId), Username: strings.ToLower(username)}
+}
+
+// cacheConnection caches a connection established by the caller, which is closed when the user already has a cached connection
+func cacheConnection(accountId int, username string, conn *memphis.Conn, expirationTime int64) {
+	if !Connections.Add(ConnectionKey(accountId, username), conn, expirationTime) {
+		conn.Close()
+	}
+}
 
 func Connect(password, username, connectionToken string, accountId int) (*memphis.Conn, error) {
 	if configuration.USER_PASS_BASED_AUTH {
@@ -48,7 +63,10 @@ func Connect(password, username, connectionToken string, accountId int) (*memphi
 		}
 	}
 	var err error
-	opts := []memphis.Option{memphis.Reconnect(true), memphis.MaxReconnect(10), memphis.ReconnectInterval(3 * time.Second)}
+	opts := []memphis.Option{memphis.Reconnect(true), memphis.MaxReconnect(maxReconnects), memphis.ReconnectInterval(reconnectInterval)}
+	if configuration.MEMPHIS_PORT != 0 {
+		opts = append(opts, memphis.Port(configuration.MEMPHIS_PORT))
+	}
 	if configuration.USER_PASS_BASED_AUTH {
 		opts = append(opts, memphis.Password(password), memphis.AccountId(accountId))
 	} else {
@@ -64,6 +82,20 @@ func Connect(password, username, connectionToken string, accountId int) (*memphi
 	return conn, nil
 }
 
+func isAuthError(err error) bool {
+	errMsg := strings.ToLower(err.Error())
+	return strings.Contains(errMsg, ErrorMsgAuthorizationViolation) || strings.Contains(errMsg, "token") || strings.Contains(errMsg, ErrorMsgMissionAccountId)
+}
+
+// getUserConnection returns the cached broker connection of the user, a new connection is established and cached in case there is none,
+// the connection stays open until the returned release func is called even if it is evicted from the cache in the meantime
+func getUserConnection(userData models.AuthSchema) (*memphis.Conn, func(), error) {
+	accountId := int(userData.AccountId)
+	return Connections.Acquire(ConnectionKey(accountId, userData.Username), userData.TokenExpiry, func() (*memphis.Conn, error) {
+		return Connect(userData.Password, userData.Username, userData.ConnectionToken, accountId)
+	})
+}
+
 func (ah AuthHandler) Authenticate(c *fiber.Ctx) error {
 	log := logger.GetLogger(c)
 	var body models.AuthSchema
@@ -78,6 +110,11 @@ func (ah AuthHandler) Authenticate(c *fiber.Ctx) error {
 			"message": err,
 		})
 	}
+	if err := validateScopes(body.Scopes); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"message": err.Error(),
+		})
+	}
 
 	accountId := int(body.AccountId)
 	if accountId == 0 {
@@ -111,7 +148,7 @@ func (ah AuthHandler) Authenticate(c *fiber.Ctx) error {
 	if accountId == 0 {
 		accountId = 1
 	}
-	token, refreshToken, tokenExpiry, refreshTokenExpiry, err := createTokens(body.TokenExpiryMins, body.RefreshTokenExpiryMins, body.Username, accountId, body.Password, body.ConnectionToken)
+	token, refreshToken, tokenExpiry, refreshTokenExpiry, err := createTokens(body.TokenExpiryMins, body.RefreshTokenExpiryMins, body.Username, accountId, body.Password, body.ConnectionToken, body.Scopes, "", "")
 	if err != nil {
 		log.Errorf("Authenticate: %s", err.Error())
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -119,17 +156,7 @@ func (ah AuthHandler) Authenticate(c *fiber.Ctx) error {
 		})
 	}
 
-	username := strings.ToLower(body.Username)
-	accountIdStr := strconv.Itoa(accountId)
-	if ConnectionsCache[accountIdStr] == nil {
-		ConnectionsCacheLock.Lock()
-		ConnectionsCache[accountIdStr] = make(map[string]Connection)
-		ConnectionsCacheLock.Unlock()
-	}
-
-	ConnectionsCacheLock.Lock()
-	ConnectionsCache[accountIdStr][username] = Connection{Connection: conn, ExpirationTime: tokenExpiry}
-	ConnectionsCacheLock.Unlock()
+	cacheConnection(accountId, body.Username, conn, tokenExpiry)
 
 	mc, err := memphisSingleton.GetMemphisConnection("", "", "") // already initialized on logger creation
 	if err != nil {
@@ -139,14 +166,21 @@ func (ah AuthHandler) Authenticate(c *fiber.Ctx) error {
 		})
 	}
 
+	// the credentials are only sent sealed, they are opened by the gateways sharing the credentials key
+	credentials, err := sealCredentials(body.Password, body.ConnectionToken)
+	if err != nil {
+		log.Errorf("Authenticate: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
 	update := models.RestGwUpdate{
 		Type: "update_connection",
 		Update: map[string]interface{}{
-			"password":         body.Password,
-			"username":         body.Username,
-			"connection_token": body.ConnectionToken,
-			"account_id":       accountId,
-			"token_expiry":     tokenExpiry,
+			"credentials":  credentials,
+			"username":     body.Username,
+			"account_id":   accountId,
+			"token_expiry": tokenExpiry,
 		},
 	}
 
@@ -175,30 +209,60 @@ func (ah AuthHandler) Authenticate(c *fiber.Ctx) error {
 	})
 }
 
-func createTokens(tokenExpiryMins, refreshTokenExpiryMins int, username string, accountId int, password, connectionToken string) (string, string, int64, int64, error) {
+// createTokens issues a new access and refresh token pair, when refreshing the family and the id of the
+// presented refresh token are passed so the presented token can't be used again
+func createTokens(tokenExpiryMins, refreshTokenExpiryMins int, username string, accountId int, password, connectionToken string, scopes []string, familyId, previousRefreshTokenId string) (string, string, int64, int64, error) {
 	if tokenExpiryMins <= 0 {
 		tokenExpiryMins = configuration.JWT_EXPIRES_IN_MINUTES
 	}
 
 	if refreshTokenExpiryMins <= 0 {
-		refreshTokenExpiryMins = configuration.JWT_EXPIRES_IN_MINUTES
+		refreshTokenExpiryMins = configuration.REFRESH_JWT_EXPIRES_IN_MINUTES
+	}
+
+	// the broker credentials are encrypted so they can't be read by whoever holds the token
+	credentials, err := sealCredentials(password, connectionToken)
+	if err != nil {
+		return "", "", 0, 0, err
+	}
+
+	tokenId, err := generateRandomId()
+	if err != nil {
+		return "", "", 0, 0, err
+	}
+	refreshTokenId, err := generateRandomId()
+	if err != nil {
+		return "", "", 0, 0, err
+	}
+	if familyId == "" {
+		previousRefreshTokenId = ""
+		familyId, err = generateRandomId()
+		if err != nil {
+			return "", "", 0, 0, err
+		}
 	}
 
 	atClaims := jwt.MapClaims{}
+	atClaims["jti"] = tokenId
+	atClaims["iat"] = time.Now().Unix()
+	atClaims["fid"] = familyId
 	atClaims["username"] = username
-	atClaims["password"] = password
+	atClaims["credentials"] = credentials
 	atClaims["account_id"] = accountId
 	atClaims["exp"] = time.Now().Add(time.Minute * time.Duration(tokenExpiryMins)).Unix()
-	atClaims["connection_token"] = connectionToken
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-	token, err := at.SignedString([]byte(configuration.JWT_SECRET))
+	if len(scopes) > 0 {
+		atClaims["scopes"] = scopes
+	}
+	token, err := signAccessToken(atClaims)
 	if err != nil {
 		return "", "", 0, 0, err
 	}
 	tokenExpiry := atClaims["exp"].(int64)
 	atClaims["token_exp"] = time.Now().Add(time.Minute * time.Duration(tokenExpiryMins)).Unix()
 	atClaims["exp"] = time.Now().Add(time.Minute * time.Duration(refreshTokenExpiryMins)).Unix()
-	at = jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
+	atClaims["jti"] = refreshTokenId
+	// refresh tokens are only ever verified by the gateways so they stay signed with the shared refresh secret
+	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
 	refreshToken, err := at.SignedString([]byte(configuration.REFRESH_JWT_SECRET))
 	if err != nil {
 		return "", "", 0, 0, err
@@ -208,7 +272,20 @@ func createTokens(tokenExpiryMins, refreshTokenExpiryMins int, username string,
 		TokenExpiration:        atClaims["token_exp"].(int64),
 	}
 
-	return token, refreshToken, tokenExpiry, refreshTokenExpiry.TokenExpiration, nil
+	family := tokenFamily{
+		RefreshTokenId: refreshTokenId,
+		Username:       strings.ToLower(username),
+		AccountId:      float64(accountId),
+		ExpiresAt:      refreshTokenExpiry.RefreshTokenExpiration,
+	}
+	if tokenExpiry > family.ExpiresAt {
+		family.ExpiresAt = tokenExpiry
+	}
+	if err := rotateTokenFamily(familyId, previousRefreshTokenId, family); err != nil {
+		return "", "", 0, 0, err
+	}
+
+	return token, refreshToken, tokenExpiry, refreshTokenExpiry.RefreshTokenExpiration, nil
 }
 
 func (ah AuthHandler) RefreshToken(c *fiber.Ctx) error {
@@ -256,7 +333,16 @@ func (ah AuthHandler) RefreshToken(c *fiber.Ctx) error {
 		})
 	}
 
-	token, refreshToken, tokenExpiry, refreshTokenExpiry, err := createTokens(body.TokenExpiryMins, body.RefreshTokenExpiryMins, username, accountId, password, connectionToken)
+	token, refreshToken, tokenExpiry, refreshTokenExpiry, err := createTokens(body.TokenExpiryMins, body.RefreshTokenExpiryMins, username, accountId, password, connectionToken, userData.Scopes, userData.TokenFamilyId, userData.TokenId)
+	if err != nil {
+		conn.Close()
+	}
+	if errors.Is(err, errRefreshTokenReused) {
+		log.Warnf("RefreshToken: refresh token of %s was used more than once, all the tokens issued with it were revoked", username)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"message": "Unauthorized",
+		})
+	}
 	if err != nil {
 		log.Errorf("RefreshToken: %s", err.Error())
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -264,16 +350,7 @@ func (ah AuthHandler) RefreshToken(c *fiber.Ctx) error {
 		})
 	}
 
-	accountId = int(accountId)
-	if ConnectionsCache[strconv.Itoa(int(accountId))] == nil {
-		ConnectionsCacheLock.Lock()
-		ConnectionsCache[strconv.Itoa(accountId)] = make(map[string]Connection)
-		ConnectionsCacheLock.Unlock()
-	}
-
-	ConnectionsCacheLock.Lock()
-	ConnectionsCache[strconv.Itoa(accountId)][username] = Connection{Connection: conn, ExpirationTime: refreshTokenExpiry}
-	ConnectionsCacheLock.Unlock()
+	cacheConnection(accountId, username, conn, refreshTokenExpiry)
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"jwt":                      token,
 		"expires_in":               tokenExpiry * 60 * 1000,
@@ -284,31 +361,10 @@ func (ah AuthHandler) RefreshToken(c *fiber.Ctx) error {
 
 func CleanConnectionsCache() {
 	for range time.Tick(time.Second * 30) {
-		for t, tenant := range ConnectionsCache {
-			for u, user := range tenant {
-				currentTime := time.Now()
-				unixTimeNow := currentTime.Unix()
-				conn := ConnectionsCache[t][u].Connection
-				if !conn.IsConnected() {
-					ConnectionsCacheLock.Lock()
-					delete(ConnectionsCache[t], u)
-					ConnectionsCacheLock.Unlock()
-				} else if unixTimeNow > int64(user.ExpirationTime) {
-					conn.Close()
-					ConnectionsCacheLock.Lock()
-					delete(ConnectionsCache[t], u)
-					ConnectionsCacheLock.Unlock()
-				}
-			}
-			if len(ConnectionsCache[t]) == 0 {
-				ConnectionsCacheLock.Lock()
-				delete(ConnectionsCache, t)
-				ConnectionsCacheLock.Unlock()
-			}
-		}
+		Connections.CleanExpired(time.Now())
 
 		if configuration.DEBUG {
-			fmt.Printf("Connections cache: %v\n", ConnectionsCache)
+			fmt.Printf("Connections cache: %v\n", Connections.Keys())
 		}
 	}
 }
@@ -332,16 +388,19 @@ func ListenForUpdates(log *logger.Logger) error {
 			username := update.Update["username"].(string)
 			accountId := int(update.Update["account_id"].(float64))
 			username = strings.ToLower(username)
-			accountIdStr := strconv.Itoa(accountId)
 
-			if ConnectionsCache[accountIdStr] != nil {
-				_, exists := ConnectionsCache[accountIdStr][username]
-				if exists {
-					return // connection already exists, nothing to update
-				}
+			if Connections.Contains(ConnectionKey(accountId, username)) {
+				return // connection already exists, nothing to update
+			}
+
+			credentials, _ := update.Update["credentials"].(string)
+			password, connectionToken, err := OpenCredentials(credentials)
+			if err != nil {
+				log.Errorf("ListenForUpdates: failed to open the credentials of %s: %s", username, err.Error())
+				return
 			}
 
-			conn, err := Connect(update.Update["password"].(string), username, update.Update["connection_token"].(string), accountId)
+			conn, err := Connect(password, username, connectionToken, accountId)
 			if err != nil {
 				errMsg := strings.ToLower(err.Error())
 				if strings.Contains(errMsg, ErrorMsgAuthorizationViolation) || strings.Contains(errMsg, "token") || strings.Contains(errMsg, ErrorMsgMissionAccountId) {
@@ -352,15 +411,11 @@ func ListenForUpdates(log *logger.Logger) error {
 				return
 			}
 
-			if ConnectionsCache[accountIdStr] == nil {
-				ConnectionsCacheLock.Lock()
-				ConnectionsCache[accountIdStr] = make(map[string]Connection)
-				ConnectionsCacheLock.Unlock()
-			}
-
-			ConnectionsCacheLock.Lock()
-			ConnectionsCache[accountIdStr][username] = Connection{Connection: conn, ExpirationTime: int64(update.Update["token_expiry"].(float64))}
-			ConnectionsCacheLock.Unlock()
+			cacheConnection(accountId, username, conn, int64(update.Update["token_expiry"].(float64)))
+		case "create_api_key", "revoke_api_key":
+			handleApiKeyUpdate(log, update)
+		case "revoke_token":
+			handleRevocationUpdate(log, update)
 		}
 	})
 	if err != nil {
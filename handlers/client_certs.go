@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"rest-gateway/models"
+	"strings"
+	"time"
+)
+
+var clientCertMappings []models.ClientCertMapping
+
+// ServerTLSConfig returns the tls configuration the gateway serves https with, nil when https is not configured
+func ServerTLSConfig() (*tls.Config, error) {
+	if configuration.HTTPS_CERT_PATH == "" || configuration.HTTPS_KEY_PATH == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(configuration.HTTPS_CERT_PATH, configuration.HTTPS_KEY_PATH)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if configuration.HTTPS_CLIENT_CA_PATH == "" {
+		return tlsConfig, nil
+	}
+
+	pemData, err := os.ReadFile(configuration.HTTPS_CLIENT_CA_PATH)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pemData) {
+		return nil, errors.New("no certificates found in HTTPS_CLIENT_CA_PATH")
+	}
+	tlsConfig.ClientCAs = clientCAs
+	// callers without a certificate can still authenticate with a token unless certificates are required
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if configuration.HTTPS_REQUIRE_CLIENT_CERT {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if err := loadClientCertMappings(); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+func loadClientCertMappings() error {
+	if configuration.CLIENT_CERT_MAPPINGS_PATH == "" {
+		return nil
+	}
+	mappingsBytes, err := os.ReadFile(configuration.CLIENT_CERT_MAPPINGS_PATH)
+	if err != nil {
+		return err
+	}
+	var mappings []models.ClientCertMapping
+	if err := json.Unmarshal(mappingsBytes, &mappings); err != nil {
+		return err
+	}
+	for i, mapping := range mappings {
+		if (mapping.CommonName == "" && mapping.San == "") || mapping.Username == "" {
+			return fmt.Errorf("mapping %d: username and common_name or san are required", i)
+		}
+		if mapping.AccountId == 0 {
+			mappings[i].AccountId = 1
+		}
+		mappings[i].Username = strings.ToLower(mapping.Username)
+		if err := validateScopes(mapping.Scopes); err != nil {
+			return fmt.Errorf("mapping %d: %s", i, err.Error())
+		}
+	}
+	clientCertMappings = mappings
+	return nil
+}
+
+func certSans(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+func certMatches(cert *x509.Certificate, mapping models.ClientCertMapping) bool {
+	if mapping.CommonName != "" && cert.Subject.CommonName != mapping.CommonName {
+		return false
+	}
+	if mapping.San == "" {
+		return true
+	}
+	for _, san := range certSans(cert) {
+		if strings.EqualFold(san, mapping.San) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientCertUser returns the user a verified client certificate is mapped to
+func ClientCertUser(state *tls.ConnectionState) (models.AuthSchema, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return models.AuthSchema{}, false
+	}
+	cert := state.PeerCertificates[0]
+	for _, mapping := range clientCertMappings {
+		if certMatches(cert, mapping) {
+			expiry := time.Now().Add(time.Duration(configuration.JWT_EXPIRES_IN_MINUTES) * time.Minute)
+			if cert.NotAfter.Before(expiry) {
+				expiry = cert.NotAfter
+			}
+			return models.AuthSchema{
+				Username:          mapping.Username,
+				Password:          mapping.Password,
+				ConnectionToken:   mapping.ConnectionToken,
+				AccountId:         mapping.AccountId,
+				TokenExpiry:       expiry.Unix(),
+				Scopes:            mapping.Scopes,
+				CredentialsExpiry: cert.NotAfter.Unix(),
+				TokenIssuedAt:     cert.NotBefore.Unix(),
+			}, true
+		}
+	}
+	return models.AuthSchema{}, false
+}
@@ -1,11 +1,11 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"rest-gateway/logger"
 	"rest-gateway/models"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -13,10 +13,65 @@ import (
 )
 
 type requestBody struct {
-	ConsumerName       string `json:"consumer_name"`
-	ConsumerGroup      string `json:"consumer_group"`
-	BatchSize          int    `json:"batch_size"`
-	BatchMaxWaitTimeMs int    `json:"batch_max_wait_time_ms"`
+	ConsumerName       string `json:"consumer_name" query:"consumer_name"`
+	ConsumerGroup      string `json:"consumer_group" query:"consumer_group"`
+	BatchSize          int    `json:"batch_size" query:"batch_size"`
+	BatchMaxWaitTimeMs int    `json:"batch_max_wait_time_ms" query:"batch_max_wait_time_ms"`
+	ManualAck          bool   `json:"manual_ack"`
+	AckDeadlineMs      int    `json:"ack_deadline_ms"`
+	MaxMsgDeliveries   int    `json:"max_msg_deliveries"`
+	Encoding           string `json:"encoding" query:"encoding"`
+	StartFromSequence  uint64 `json:"start_consume_from_sequence" query:"start_consume_from_sequence"`
+	LastMessages       int64  `json:"last_messages" query:"last_messages"`
+	StartTime          string `json:"start_time" query:"start_time"`
+	Wait               int    `json:"wait" query:"wait"`
+}
+
+// startPositionOpts maps the requested start position onto fetch options, a start position can only be applied when the
+// consumer group is created so errConsumerGroupExists is returned for existing groups
+func (r *requestBody) startPositionOpts(userData models.AuthSchema, stationName string) ([]memphis.FetchOpt, error) {
+	positions := 0
+	for _, isSet := range []bool{r.StartFromSequence > 0, r.LastMessages > 0, r.StartTime != ""} {
+		if isSet {
+			positions++
+		}
+	}
+	if positions > 1 {
+		return nil, errors.New("only one of start_consume_from_sequence, last_messages and start_time can be set")
+	}
+	if positions == 0 {
+		return nil, nil
+	}
+	var startTime time.Time
+	if r.StartTime != "" {
+		var err error
+		startTime, err = time.Parse(time.RFC3339, r.StartTime)
+		if err != nil {
+			return nil, errors.New("start_time should be an RFC3339 timestamp")
+		}
+	}
+
+	nc, release, err := getUserNatsConn(userData)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	js := nc.js
+	if err := ensureNewConsumerGroup(js, stationName, r.ConsumerGroup); err != nil {
+		return nil, err
+	}
+	switch {
+	case r.StartFromSequence > 0:
+		return []memphis.FetchOpt{fetchStartConsumeFromSequence(r.StartFromSequence)}, nil
+	case r.LastMessages > 0:
+		return []memphis.FetchOpt{fetchLastMessages(r.LastMessages)}, nil
+	default:
+		seq, err := sequenceForTime(js, stationName, startTime)
+		if err != nil {
+			return nil, err
+		}
+		return []memphis.FetchOpt{fetchStartConsumeFromSequence(seq)}, nil
+	}
 }
 
 func (r *requestBody) initializeDefaults() {
@@ -25,20 +80,34 @@ func (r *requestBody) initializeDefaults() {
 	} else {
 		r.ConsumerGroup = fmt.Sprintf("%s-rest-gateway", r.ConsumerGroup)
 	}
+	if r.ManualAck {
+		// the delivery settings of a consumer group are fixed when it is created, manual ack consumers get groups of
+		// their own so they are never served by a group which does not redeliver unacked messages
+		r.ConsumerGroup = fmt.Sprintf("%s-%s", r.ConsumerGroup, manualAckSuffix)
+		r.ConsumerName = fmt.Sprintf("%s-%s", r.ConsumerName, manualAckSuffix)
+	}
 	if r.BatchSize == 0 {
 		r.BatchSize = 10
 	}
 	if r.BatchMaxWaitTimeMs == 0 {
-		r.BatchMaxWaitTimeMs = 5000
+		if r.Wait > 0 {
+			r.BatchMaxWaitTimeMs = longPollSliceMs
+		} else {
+			r.BatchMaxWaitTimeMs = 5000
+		}
+	}
+	if r.AckDeadlineMs == 0 {
+		r.AckDeadlineMs = defaultAckDeadlineMs
+	}
+	if r.MaxMsgDeliveries == 0 {
+		r.MaxMsgDeliveries = defaultManualAckMaxDelivery
 	}
 }
 
 func ConsumeHandleMessage() func(*fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		log := logger.GetLogger(c)
-		url := c.Request().URI().String()
-		urlParts := strings.Split(url, "/")
-		stationName := urlParts[4]
+		stationName := StationName(c)
 		reqBody := requestBody{}
 		err := c.BodyParser(&reqBody)
 		if err != nil {
@@ -56,6 +125,26 @@ func ConsumeHandleMessage() func(*fiber.Ctx) error {
 				"error":   "Consumer name is required",
 			})
 		}
+		if reqBody.Encoding == "" {
+			reqBody.Encoding = c.Query("encoding")
+		}
+		if reqBody.Wait == 0 {
+			reqBody.Wait = c.QueryInt("wait")
+		}
+		if reqBody.Wait < 0 {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "wait should be a positive number of seconds",
+			})
+		}
+		if !isValidEncoding(reqBody.Encoding) {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "Unsupported encoding, supported encodings are utf8, base64 and json",
+			})
+		}
 		userData, ok := c.Locals("userData").(models.AuthSchema)
 		if !ok {
 			log.Errorf("ConsumeHandleMessage: failed to get the user data from the middleware")
@@ -68,56 +157,92 @@ func ConsumeHandleMessage() func(*fiber.Ctx) error {
 		username := userData.Username
 		accountId := userData.AccountId
 		accountIdStr := strconv.Itoa(int(accountId))
-		conn := ConnectionsCache[accountIdStr][username].Connection
-		if conn == nil {
-			conn, err = Connect(userData.Password, username, userData.ConnectionToken, int(accountId))
-			if err != nil {
-				errMsg := strings.ToLower(err.Error())
-				if strings.Contains(errMsg, ErrorMsgAuthorizationViolation) || strings.Contains(errMsg, "token") || strings.Contains(errMsg, ErrorMsgMissionAccountId) {
-					log.Warnf("Could not establish new connection with the broker: Authentication error")
-					return c.Status(401).JSON(fiber.Map{
-						"message": "Unauthorized",
-					})
-				}
-
-				log.Errorf("Could not establish new connection with the broker: %s", err.Error())
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"message": "Server error",
+		conn, release, err := getUserConnection(userData)
+		if err != nil {
+			if isAuthError(err) {
+				log.Warnf("Could not establish new connection with the broker: Authentication error")
+				return c.Status(401).JSON(fiber.Map{
+					"message": "Unauthorized",
 				})
 			}
-			if ConnectionsCache[accountIdStr] == nil {
-				ConnectionsCacheLock.Lock()
-				ConnectionsCache[accountIdStr] = make(map[string]Connection)
-				ConnectionsCacheLock.Unlock()
-			}
 
-			ConnectionsCacheLock.Lock()
-			ConnectionsCache[accountIdStr][username] = Connection{Connection: conn, ExpirationTime: userData.TokenExpiry}
-			ConnectionsCacheLock.Unlock()
+			log.Errorf("Could not establish new connection with the broker: %s", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"message": "Server error",
+			})
 		}
+		defer release()
 		reqBody.initializeDefaults()
-		msgs, err := conn.FetchMessages(stationName, reqBody.ConsumerName,
+		fetchOpts := []memphis.FetchOpt{
 			memphis.FetchBatchSize(reqBody.BatchSize),
 			memphis.FetchConsumerGroup(reqBody.ConsumerGroup),
-			memphis.FetchBatchMaxWaitTime(time.Duration(reqBody.BatchMaxWaitTimeMs)*time.Millisecond),
-			memphis.FetchMaxMsgDeliveries(1)) // for cases of broker crash before sending the messages to the client
+			memphis.FetchBatchMaxWaitTime(time.Duration(reqBody.BatchMaxWaitTimeMs) * time.Millisecond),
+		}
+		if reqBody.ManualAck {
+			// unacked messages are redelivered by the broker once the ack deadline has passed
+			fetchOpts = append(fetchOpts,
+				memphis.FetchMaxAckTime(time.Duration(reqBody.AckDeadlineMs)*time.Millisecond),
+				memphis.FetchMaxMsgDeliveries(reqBody.MaxMsgDeliveries))
+		} else {
+			fetchOpts = append(fetchOpts, memphis.FetchMaxMsgDeliveries(1)) // for cases of broker crash before sending the messages to the client
+		}
+		startOpts, err := reqBody.startPositionOpts(userData, stationName)
+		if err != nil {
+			if errors.Is(err, errConsumerGroupExists) {
+				c.Status(fiber.StatusConflict)
+			} else {
+				c.Status(fiber.StatusBadRequest)
+			}
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		fetchOpts = append(fetchOpts, startOpts...)
+		var msgs []*memphis.Msg
+		if reqBody.Wait > 0 {
+			var clientGone bool
+			msgs, clientGone, err = fetchWithWait(c, conn, stationName, reqBody.ConsumerName, longPollWait(reqBody.Wait), fetchOpts...)
+			if clientGone {
+				log.Debugf("ConsumeHandleMessage - client disconnected while waiting for messages")
+				return nil
+			}
+		} else {
+			msgs, err = conn.FetchMessages(stationName, reqBody.ConsumerName, fetchOpts...)
+		}
 
-		if err != nil && !strings.Contains(err.Error(), "fetch timed out") {
+		if err != nil && !isFetchTimeout(err) {
 			log.Errorf("ConsumeHandleMessage - fetch messages: %s", err.Error())
-			c.Status(fiber.StatusBadRequest)
+			if isBrokerUnavailable(conn, err) {
+				setRetryAfter(c)
+				c.Status(fiber.StatusServiceUnavailable)
+			} else {
+				c.Status(fiber.StatusBadRequest)
+			}
 			return c.JSON(&fiber.Map{
 				"success": false,
 				"error":   err.Error(),
 			})
 		}
-
-		type message struct {
-			Message string            `json:"message"`
-			Headers map[string]string `json:"headers"`
+		if reqBody.Wait > 0 && len(msgs) == 0 {
+			setRetryAfter(c)
+			return c.SendStatus(fiber.StatusNoContent)
 		}
-		messages := []message{}
+
+		messages := []consumedMessage{}
 
 		for _, msg := range msgs {
+			message := newConsumedMessage(msg.Data(), msg.GetHeaders(), reqBody.Encoding)
+			if reqBody.ManualAck {
+				ackToken, err := sealAckToken(msg, stationName, accountIdStr, username, time.Duration(reqBody.AckDeadlineMs)*time.Millisecond)
+				if err != nil {
+					log.Errorf("ConsumeHandleMessage - seal ack token: %s", err.Error())
+					continue // the message will be redelivered once its ack deadline has passed
+				}
+				message.AckToken = ackToken
+				messages = append(messages, message)
+				continue
+			}
 			err := msg.Ack()
 			if err != nil {
 				time.AfterFunc(5*time.Second, func() { // retry after 5 seconds for cases of broker crash
@@ -127,12 +252,9 @@ func ConsumeHandleMessage() func(*fiber.Ctx) error {
 					}
 				})
 			}
-			messages = append(messages, message{
-				Message: string(msg.Data()),
-				Headers: msg.GetHeaders(),
-			})
+			messages = append(messages, message)
 		}
 		c.Status(fiber.StatusOK)
-		return c.JSON(&messages)
+		return writeConsumedMessages(c, messages)
 	}
 }
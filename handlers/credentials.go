@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"rest-gateway/utils"
+)
+
+// brokerCredentials are never handed out in the clear, tokens and stored subscriptions only carry them sealed
+type brokerCredentials struct {
+	Password        string `json:"password,omitempty"`
+	ConnectionToken string `json:"connection_token,omitempty"`
+}
+
+func credentialsKey() []byte {
+	secret := configuration.CREDENTIALS_ENCRYPTION_KEY
+	if secret == "" {
+		// all the gateways share the jwt secret so they can open each other's tokens
+		secret = "credentials:" + configuration.JWT_SECRET
+	}
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}
+
+func sealCredentials(password, connectionToken string) (string, error) {
+	plaintext, err := json.Marshal(brokerCredentials{Password: password, ConnectionToken: connectionToken})
+	if err != nil {
+		return "", err
+	}
+	return utils.Encrypt(credentialsKey(), plaintext)
+}
+
+// sealSecret encrypts a secret the gateways need to read back, e.g. the hmac secret of a webhook subscription
+func sealSecret(secret string) (string, error) {
+	return utils.Encrypt(credentialsKey(), []byte(secret))
+}
+
+func openSecret(sealed string) (string, error) {
+	plaintext, err := utils.Decrypt(credentialsKey(), sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// OpenCredentials returns the password and connection token sealed into a token or a stored subscription
+func OpenCredentials(sealed string) (string, string, error) {
+	plaintext, err := utils.Decrypt(credentialsKey(), sealed)
+	if err != nil {
+		return "", "", err
+	}
+	var creds brokerCredentials
+	if err := json.Unmarshal(plaintext, &creds); err != nil {
+		return "", "", err
+	}
+	return creds.Password, creds.ConnectionToken, nil
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	encodingUtf8         = "utf8"
+	encodingBase64       = "base64"
+	encodingJson         = "json"
+	ndjsonContentType    = "application/x-ndjson"
+	multipartContentType = "multipart/mixed"
+	ackTokenHeader       = "X-Memphis-Ack-Token"
+	msgHeadersHeader     = "X-Memphis-Headers"
+)
+
+type consumedMessage struct {
+	Message  any               `json:"message"`
+	Headers  map[string]string `json:"headers"`
+	Encoding string            `json:"encoding,omitempty"`
+	AckToken string            `json:"ack_token,omitempty"`
+	data     []byte
+}
+
+func isValidEncoding(encoding string) bool {
+	switch encoding {
+	case "", encodingUtf8, encodingBase64, encodingJson:
+		return true
+	}
+	return false
+}
+
+// newConsumedMessage encodes the payload according to the requested encoding,
+// with the json encoding payloads which are not valid json fall back to base64
+func newConsumedMessage(data []byte, headers map[string]string, encoding string) consumedMessage {
+	msg := consumedMessage{Headers: headers, Encoding: encoding, data: data}
+	switch encoding {
+	case encodingJson:
+		if json.Valid(data) {
+			msg.Message = json.RawMessage(data)
+		} else {
+			msg.Message = base64.StdEncoding.EncodeToString(data)
+			msg.Encoding = encodingBase64
+		}
+	case encodingBase64:
+		msg.Message = base64.StdEncoding.EncodeToString(data)
+	default:
+		msg.Message = string(data)
+	}
+	return msg
+}
+
+// writeConsumedMessages renders the messages according to the Accept header, a json array is returned by default
+func writeConsumedMessages(c *fiber.Ctx, messages []consumedMessage) error {
+	switch c.Accepts(fiber.MIMEApplicationJSON, ndjsonContentType, multipartContentType) {
+	case ndjsonContentType:
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, msg := range messages {
+			if err := encoder.Encode(msg); err != nil {
+				return err
+			}
+		}
+		c.Set(fiber.HeaderContentType, ndjsonContentType)
+		return c.Send(buf.Bytes())
+	case multipartContentType:
+		var buf bytes.Buffer
+		writer := multipart.NewWriter(&buf)
+		for _, msg := range messages {
+			partHeaders := textproto.MIMEHeader{}
+			contentType := msg.Headers[fiber.HeaderContentType]
+			if contentType == "" {
+				contentType = fiber.MIMEOctetStream
+			}
+			partHeaders.Set(fiber.HeaderContentType, contentType)
+			hdrs, err := json.Marshal(msg.Headers)
+			if err != nil {
+				return err
+			}
+			partHeaders.Set(msgHeadersHeader, string(hdrs))
+			if msg.AckToken != "" {
+				partHeaders.Set(ackTokenHeader, msg.AckToken)
+			}
+			part, err := writer.CreatePart(partHeaders)
+			if err != nil {
+				return err
+			}
+			if _, err := part.Write(msg.data); err != nil {
+				return err
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderContentType, multipartContentType+"; boundary="+writer.Boundary())
+		return c.Send(buf.Bytes())
+	default:
+		return c.JSON(&messages)
+	}
+}
@@ -0,0 +1,20 @@
+package handlers
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	msgIdHeader          = "Msg-Id"
+)
+
+// extractMsgId removes the idempotency headers from the request headers so they are not produced as regular headers
+func extractMsgId(headers map[string][]string) string {
+	msgId := ""
+	for _, key := range []string{msgIdHeader, idempotencyKeyHeader} {
+		if value, ok := headers[key]; ok {
+			if len(value) > 0 && value[0] != "" {
+				msgId = value[0]
+			}
+			delete(headers, key)
+		}
+	}
+	return msgId
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwtKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer // nil for keys that are only kept to verify tokens signed before a rotation
+	public  crypto.PublicKey
+}
+
+// access tokens are signed with the active key, all the configured keys are accepted and published in the jwks
+// so a new key can be rolled out before it becomes active and an old one can be kept until its tokens expire
+var jwtKeys = map[string]jwtKey{}
+var activeJwtKey *jwtKey
+
+// LoadJwtKeys loads the asymmetric keys configured in JWT_KEYS as kid=path-to-pem entries,
+// without an active key access tokens are signed with JWT_SECRET
+func LoadJwtKeys() error {
+	for _, entry := range configuration.JWT_KEYS {
+		entry = strings.Trim(strings.TrimSpace(entry), `"`)
+		kid, path, found := strings.Cut(entry, "=")
+		if !found || kid == "" || path == "" {
+			return fmt.Errorf("invalid JWT_KEYS entry %q, expected kid=path", entry)
+		}
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key, err := parseJwtKey(kid, pemBytes)
+		if err != nil {
+			return fmt.Errorf("key %s: %s", kid, err.Error())
+		}
+		jwtKeys[kid] = key
+	}
+
+	if configuration.JWT_ACTIVE_KID != "" {
+		key, ok := jwtKeys[configuration.JWT_ACTIVE_KID]
+		if !ok {
+			return fmt.Errorf("active key %s is not configured in JWT_KEYS", configuration.JWT_ACTIVE_KID)
+		}
+		if key.private == nil {
+			return fmt.Errorf("active key %s should be a private key", key.kid)
+		}
+		activeJwtKey = &key
+	}
+	return nil
+}
+
+func parseJwtKey(kid string, pemBytes []byte) (jwtKey, error) {
+	key := jwtKey{kid: kid}
+	if private, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes); err == nil {
+		key.private, key.public = private, &private.PublicKey
+	} else if private, err := jwt.ParseECPrivateKeyFromPEM(pemBytes); err == nil {
+		key.private, key.public = private, &private.PublicKey
+	} else if public, err := jwt.ParseRSAPublicKeyFromPEM(pemBytes); err == nil {
+		key.public = public
+	} else if public, err := jwt.ParseECPublicKeyFromPEM(pemBytes); err == nil {
+		key.public = public
+	} else {
+		return jwtKey{}, errors.New("unsupported key, expected an RSA or EC key in PEM format")
+	}
+
+	method, err := signingMethodFor(key.public)
+	if err != nil {
+		return jwtKey{}, err
+	}
+	key.method = method
+	return key, nil
+}
+
+func signingMethodFor(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch public.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+func signAccessToken(claims jwt.MapClaims) (string, error) {
+	if activeJwtKey == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(configuration.JWT_SECRET))
+	}
+	token := jwt.NewWithClaims(activeJwtKey.method, claims)
+	token.Header["kid"] = activeJwtKey.kid
+	return token.SignedString(activeJwtKey.private)
+}
+
+// AccessTokenKey returns the key an access token should be verified with based on its alg and kid headers
+func AccessTokenKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return []byte(configuration.JWT_SECRET), nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := jwtKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+func publicJwk(key jwtKey) jwk {
+	res := jwk{Kid: key.kid, Use: "sig", Alg: key.method.Alg()}
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		res.Kty = "RSA"
+		res.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		res.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		res.Kty = "EC"
+		res.Crv = public.Curve.Params().Name
+		res.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+		res.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+	}
+	return res
+}
+
+func (ah AuthHandler) Jwks(c *fiber.Ctx) error {
+	keys := jwkSet{Keys: []jwk{}}
+	for _, key := range jwtKeys {
+		keys.Keys = append(keys.Keys, publicJwk(key))
+	}
+	sort.Slice(keys.Keys, func(i, j int) bool { return keys.Keys[i].Kid < keys.Keys[j].Kid })
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(fiber.StatusOK).JSON(keys)
+}
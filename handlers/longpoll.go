@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"rest-gateway/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/memphisdev/memphis.go"
+	"github.com/nats-io/nats.go"
+)
+
+// while long polling the client is checked every slice so a disconnect is noticed quickly
+const longPollSliceMs = 1000
+
+// isFetchTimeout reports whether the fetch ended only because no messages arrived in time,
+// the sdk rewrites nats errors into plain strings so the message has to be inspected
+func isFetchTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, nats.ErrTimeout) {
+		return true
+	}
+	errMsg := strings.ToLower(err.Error())
+	return strings.Contains(errMsg, "timed out") || strings.Contains(errMsg, "timeout")
+}
+
+func isBrokerUnavailable(conn *memphis.Conn, err error) bool {
+	if !conn.IsConnected() {
+		return true
+	}
+	errMsg := strings.ToLower(err.Error())
+	return strings.Contains(errMsg, "station unreachable") || strings.Contains(errMsg, "connection closed") || strings.Contains(errMsg, "no responders")
+}
+
+func longPollWait(waitSeconds int) time.Duration {
+	maxWait := configuration.CONSUME_MAX_WAIT_SECONDS
+	if maxWait > 0 && waitSeconds > maxWait {
+		waitSeconds = maxWait
+	}
+	return time.Duration(waitSeconds) * time.Second
+}
+
+func setRetryAfter(c *fiber.Ctx) {
+	retryAfter := configuration.CONSUME_RETRY_AFTER_SECONDS
+	if retryAfter <= 0 {
+		retryAfter = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+}
+
+type fetchResult struct {
+	msgs []*memphis.Msg
+	err  error
+}
+
+// fetchWithWait keeps fetching until messages arrive, the wait expires or the client goes away,
+// clientGone is true when the request was abandoned and no response should be written.
+// Cached or existing consumers keep the max wait they were created with, so every fetch runs in the background
+// while the gateway checks the client every slice. A fetch still running when the wait expires is waited for,
+// so the messages it returns are not lost, and the messages of a fetch the client has left are nacked.
+func fetchWithWait(c *fiber.Ctx, conn *memphis.Conn, stationName, consumerName string, wait time.Duration, opts ...memphis.FetchOpt) (msgs []*memphis.Msg, clientGone bool, err error) {
+	deadline := time.Now().Add(wait)
+	slice := time.NewTicker(longPollSliceMs * time.Millisecond)
+	defer slice.Stop()
+	for {
+		done := make(chan fetchResult, 1)
+		go func() {
+			msgs, err := conn.FetchMessages(stationName, consumerName, opts...)
+			done <- fetchResult{msgs: msgs, err: err}
+		}()
+
+		var res fetchResult
+	waiting:
+		for {
+			select {
+			case res = <-done:
+				break waiting
+			case <-slice.C:
+				if isClientGone(c) {
+					go nackAbandonedFetch(done)
+					return nil, true, nil
+				}
+			}
+		}
+		if res.err != nil && !isFetchTimeout(res.err) {
+			return nil, false, res.err
+		}
+		if len(res.msgs) > 0 || !time.Now().Before(deadline) {
+			return res.msgs, false, nil
+		}
+		if isClientGone(c) {
+			return nil, true, nil
+		}
+	}
+}
+
+func isClientGone(c *fiber.Ctx) bool {
+	select {
+	case <-c.Context().Done(): // server shutdown
+		return true
+	default:
+	}
+	return utils.IsConnClosed(c.Context().Conn())
+}
+
+// nackAbandonedFetch hands the messages of a fetch whose client has left back to the broker
+func nackAbandonedFetch(done chan fetchResult) {
+	res := <-done
+	for _, msg := range res.msgs {
+		msg.Nack()
+	}
+}
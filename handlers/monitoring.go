@@ -14,6 +14,12 @@ import (
 type MonitoringHandler struct{}
 
 func (ih MonitoringHandler) Status(c *fiber.Ctx) error {
+	if outboxEnabled {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"status": "ok",
+			"outbox": outboxStatus(),
+		})
+	}
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"status": "ok",
 	})
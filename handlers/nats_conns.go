@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"rest-gateway/connpool"
+	"rest-gateway/models"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/memphisdev/memphis.go"
+	"github.com/nats-io/nats.go"
+)
+
+// userNatsConn is a plain broker connection made with the user's credentials, for the requests the sdk does not expose
+// (e.g. looking up the station's stream), so they are made in the user's account and with the user's permissions
+type userNatsConn struct {
+	nc *nats.Conn
+	js nats.JetStreamContext
+}
+
+// every pooled user connection gets at most one plain connection, which is closed together with it
+var natsConns = map[*memphis.Conn]*userNatsConn{}
+var natsConnsLock sync.Mutex
+
+func init() {
+	Connections.OnEvict(func(_ connpool.Key, conn *memphis.Conn) {
+		natsConnsLock.Lock()
+		unc, ok := natsConns[conn]
+		delete(natsConns, conn)
+		natsConnsLock.Unlock()
+		if ok {
+			unc.nc.Close()
+		}
+	})
+}
+
+func brokerUrl() string {
+	port := configuration.MEMPHIS_PORT
+	if port == 0 {
+		port = defaultMemphisPort
+	}
+	return configuration.MEMPHIS_HOST + ":" + strconv.Itoa(port)
+}
+
+func connectNats(userData models.AuthSchema) (*userNatsConn, error) {
+	opts := []nats.Option{nats.Name("rest-gateway::" + userData.Username), nats.MaxReconnects(maxReconnects), nats.ReconnectWait(reconnectInterval)}
+	if configuration.CLIENT_CERT_PATH != "" && configuration.CLIENT_KEY_PATH != "" && configuration.ROOT_CA_PATH != "" {
+		opts = append(opts, nats.ClientCert(configuration.CLIENT_CERT_PATH, configuration.CLIENT_KEY_PATH), nats.RootCAs(configuration.ROOT_CA_PATH))
+	}
+	var nc *nats.Conn
+	var err error
+	if configuration.USER_PASS_BASED_AUTH {
+		accountId := int(userData.AccountId)
+		if accountId == 0 {
+			accountId = 1
+		}
+		nc, err = nats.Connect(brokerUrl(), append(opts, nats.UserInfo(userData.Username+"$"+strconv.Itoa(accountId), userData.Password))...)
+		if err != nil && strings.Contains(strings.ToLower(err.Error()), ErrorMsgAuthorizationViolation) {
+			// brokers without accounts know the user by its plain username
+			nc, err = nats.Connect(brokerUrl(), append(opts, nats.UserInfo(userData.Username, userData.Password))...)
+		}
+	} else {
+		nc, err = nats.Connect(brokerUrl(), append(opts, nats.Token(userData.ConnectionToken))...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &userNatsConn{nc: nc, js: js}, nil
+}
+
+// getUserNatsConn returns the plain connection paired with the user's pooled connection, it stays open until the returned
+// release func is called
+func getUserNatsConn(userData models.AuthSchema) (*userNatsConn, func(), error) {
+	conn, release, err := getUserConnection(userData)
+	if err != nil {
+		return nil, nil, err
+	}
+	natsConnsLock.Lock()
+	unc, ok := natsConns[conn]
+	natsConnsLock.Unlock()
+	if ok {
+		return unc, release, nil
+	}
+
+	unc, err = connectNats(userData)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	natsConnsLock.Lock()
+	if existing, ok := natsConns[conn]; ok { // connected concurrently by another request
+		natsConnsLock.Unlock()
+		unc.nc.Close()
+		return existing, release, nil
+	}
+	natsConns[conn] = unc
+	natsConnsLock.Unlock()
+	return unc, release, nil
+}
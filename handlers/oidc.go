@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"rest-gateway/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const oidcKeysTTL = 10 * time.Minute
+const oidcKeysMinRefreshInterval = time.Minute
+
+var oidcMappings []models.OidcUserMapping
+var oidcKeys = map[string]crypto.PublicKey{}
+var oidcKeysFetchedAt time.Time
+var oidcKeysLock sync.Mutex
+var oidcKeysInflight *oidcKeysFetch
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// OidcEnabled reports whether tokens issued by an external identity provider are accepted
+func OidcEnabled() bool {
+	return configuration.OIDC_ISSUER != ""
+}
+
+// LoadOidcMappings loads the table mapping identity provider claims onto Memphis service users
+func LoadOidcMappings() error {
+	if !OidcEnabled() {
+		return nil
+	}
+	if configuration.OIDC_USER_MAPPINGS_PATH == "" {
+		return errors.New("OIDC_USER_MAPPINGS_PATH is required when OIDC_ISSUER is set")
+	}
+	mappingsBytes, err := os.ReadFile(configuration.OIDC_USER_MAPPINGS_PATH)
+	if err != nil {
+		return err
+	}
+	var mappings []models.OidcUserMapping
+	if err := json.Unmarshal(mappingsBytes, &mappings); err != nil {
+		return err
+	}
+	for i, mapping := range mappings {
+		if mapping.Claim == "" || mapping.Username == "" {
+			return fmt.Errorf("mapping %d: claim and username are required", i)
+		}
+		if mapping.AccountId == 0 {
+			mappings[i].AccountId = 1
+		}
+		mappings[i].Username = strings.ToLower(mapping.Username)
+		if err := validateScopes(mapping.Scopes); err != nil {
+			return fmt.Errorf("mapping %d: %s", i, err.Error())
+		}
+	}
+	oidcMappings = mappings
+	return nil
+}
+
+// IsOidcToken reports whether the token was issued by the configured identity provider, the token is not verified
+func IsOidcToken(tokenString string) bool {
+	if !OidcEnabled() {
+		return false
+	}
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+	if err != nil {
+		return false
+	}
+	issuer, _ := claims["iss"].(string)
+	return issuer == configuration.OIDC_ISSUER
+}
+
+// VerifyOidcToken validates a token issued by the identity provider and returns the service user its claims are mapped to
+func VerifyOidcToken(tokenString string) (models.AuthSchema, error) {
+	token, err := jwt.Parse(tokenString, oidcKey)
+	if err != nil {
+		return models.AuthSchema{}, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return models.AuthSchema{}, errors.New("invalid token")
+	}
+	if !claims.VerifyIssuer(configuration.OIDC_ISSUER, true) {
+		return models.AuthSchema{}, errors.New("unexpected issuer")
+	}
+	if configuration.OIDC_AUDIENCE != "" && !claims.VerifyAudience(configuration.OIDC_AUDIENCE, true) {
+		return models.AuthSchema{}, errors.New("unexpected audience")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return models.AuthSchema{}, errors.New("token has no expiration")
+	}
+	iat, _ := claims["iat"].(float64) // tokens without it are rejected once the user is revoked
+
+	for _, mapping := range oidcMappings {
+		if claimMatches(claims[mapping.Claim], mapping.Value) {
+			return models.AuthSchema{
+				Username:          mapping.Username,
+				Password:          mapping.Password,
+				ConnectionToken:   mapping.ConnectionToken,
+				AccountId:         mapping.AccountId,
+				TokenExpiry:       int64(exp),
+				Scopes:            mapping.Scopes,
+				CredentialsExpiry: int64(exp),
+				TokenIssuedAt:     int64(iat),
+			}, nil
+		}
+	}
+	return models.AuthSchema{}, errors.New("no user mapping matches the token")
+}
+
+// claimMatches supports string and list claims (e.g. groups), an empty value matches any identity that has the claim
+func claimMatches(claim interface{}, value string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return value == "" || claim == value
+	case []interface{}:
+		for _, item := range claim {
+			if item, ok := item.(string); ok && (value == "" || item == value) {
+				return true
+			}
+		}
+	case bool:
+		return value == "" || fmt.Sprint(claim) == value
+	}
+	return false
+}
+
+func oidcKey(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+	default:
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+
+	oidcKeysLock.Lock()
+	key, ok := oidcKeys[kid]
+	expired := time.Since(oidcKeysFetchedAt) > oidcKeysTTL
+	var fetch *oidcKeysFetch
+	// an unknown kid usually means the provider rotated its keys
+	if expired || (!ok && time.Since(oidcKeysFetchedAt) > oidcKeysMinRefreshInterval) {
+		fetch = startOidcKeysFetch()
+	}
+	oidcKeysLock.Unlock()
+	// a cached key is used while the keys are refreshed, an unknown one waits for the new keys
+	if !ok && fetch != nil {
+		<-fetch.done
+		if fetch.err != nil {
+			return nil, fetch.err
+		}
+		oidcKeysLock.Lock()
+		key, ok = oidcKeys[kid]
+		oidcKeysLock.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if _, isEC := token.Method.(*jwt.SigningMethodECDSA); isEC {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+	case *ecdsa.PublicKey:
+		if _, isEC := token.Method.(*jwt.SigningMethodECDSA); !isEC {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+	}
+	return key, nil
+}
+
+// oidcKeysFetch is a fetch of the provider's keys in progress, it is shared by the requests that need the new keys
+type oidcKeysFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// startOidcKeysFetch fetches the provider's keys in the background unless a fetch is already in progress and swaps
+// them in once fetched, it must be called while holding oidcKeysLock which is not held during the fetch itself
+func startOidcKeysFetch() *oidcKeysFetch {
+	if oidcKeysInflight != nil {
+		return oidcKeysInflight
+	}
+	fetch := &oidcKeysFetch{done: make(chan struct{})}
+	oidcKeysInflight = fetch
+	go func() {
+		keys, err := fetchOidcKeys()
+		oidcKeysLock.Lock()
+		if err == nil {
+			oidcKeys = keys
+			oidcKeysFetchedAt = time.Now()
+		}
+		oidcKeysInflight = nil
+		oidcKeysLock.Unlock()
+		fetch.err = err
+		close(fetch.done)
+	}()
+	return fetch
+}
+
+// fetchOidcKeys loads the provider's keys from OIDC_JWKS_URL which can be a url or a local file,
+// when it is not set the jwks url is discovered from the issuer's openid configuration
+func fetchOidcKeys() (map[string]crypto.PublicKey, error) {
+	jwksUrl := configuration.OIDC_JWKS_URL
+	if jwksUrl == "" {
+		var discovery struct {
+			JwksUri string `json:"jwks_uri"`
+		}
+		err := fetchOidcDocument(strings.TrimSuffix(configuration.OIDC_ISSUER, "/")+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return nil, err
+		}
+		jwksUrl = discovery.JwksUri
+	}
+
+	var keySet jwkSet
+	if err := fetchOidcDocument(jwksUrl, &keySet); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range keySet.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		public, err := key.publicKey()
+		if err != nil {
+			continue // keys of unsupported types are ignored
+		}
+		keys[key.Kid] = public
+	}
+	return keys, nil
+}
+
+func fetchOidcDocument(location string, v interface{}) error {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		document, err := os.ReadFile(strings.TrimPrefix(location, "file://"))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(document, v)
+	}
+
+	res, err := oidcClient.Get(location)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s failed with status %d", location, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"rest-gateway/connpool"
+	"rest-gateway/logger"
+	"rest-gateway/models"
+	"rest-gateway/outbox"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/memphisdev/memphis.go"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	batchResultQueued = "queued"
+
+	outboxConnectionsDir = "connections"
+	outboxDeadLetterDir  = "dead-letter"
+)
+
+var errOutboxCredentials = errors.New("the credentials of the message can not be read")
+
+type outboxEntry struct {
+	StationName  string              `json:"station_name"`
+	ProducerName string              `json:"producer_name"`
+	Username     string              `json:"username"`
+	AccountId    float64             `json:"account_id"`
+	Credentials  string              `json:"credentials"`
+	Payload      []byte              `json:"payload"`
+	Headers      map[string][]string `json:"headers"`
+	MsgId        string              `json:"msg_id,omitempty"`
+	PartitionKey string              `json:"partition_key,omitempty"`
+}
+
+// deadLetter is a record that can never be produced, kept with the reason it failed
+type deadLetter struct {
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+	Record   []byte    `json:"record"`
+}
+
+// connOutbox holds the produce requests of a user connection accepted while the broker was unreachable,
+// every connection has its own outbox and replay loop so a message that can't be produced only holds back its own user
+type connOutbox struct {
+	key     connpool.Key
+	dir     string
+	ob      *outbox.Outbox
+	writers int // requests appending to the outbox, it is not closed while there are any
+}
+
+var outboxEnabled bool
+var outboxLog *logger.Logger
+var connOutboxes = map[connpool.Key]*connOutbox{}
+var connOutboxesLock sync.Mutex
+
+// deadLetters holds the messages of all the connections that can never be produced, it is never replayed
+var deadLetters *outbox.Outbox
+
+// outboxBudget caps the total size of the connection outboxes and the dead letters
+var outboxBudget *outbox.Budget
+
+func outboxOptions() outbox.Options {
+	return outbox.Options{
+		Budget:        outboxBudget,
+		SegmentBytes:  configuration.OUTBOX_SEGMENT_BYTES,
+		Fsync:         configuration.OUTBOX_FSYNC,
+		FsyncInterval: time.Duration(configuration.OUTBOX_FSYNC_INTERVAL_MS) * time.Millisecond,
+	}
+}
+
+func connOutboxDir(key connpool.Key) string {
+	return filepath.Join(configuration.OUTBOX_DIR, outboxConnectionsDir, key.AccountId+"-"+hex.EncodeToString([]byte(key.Username)))
+}
+
+func parseConnOutboxDir(name string) (connpool.Key, bool) {
+	accountId, username, ok := strings.Cut(name, "-")
+	if !ok {
+		return connpool.Key{}, false
+	}
+	decoded, err := hex.DecodeString(username)
+	if err != nil {
+		return connpool.Key{}, false
+	}
+	return connpool.Key{AccountId: accountId, Username: string(decoded)}, true
+}
+
+// OpenOutbox opens the outboxes left over from a previous run and starts replaying them, nothing is done unless OUTBOX_DIR is set
+func OpenOutbox(log *logger.Logger) error {
+	if configuration.OUTBOX_DIR == "" {
+		return nil
+	}
+	outboxLog = log
+	outboxBudget = outbox.NewBudget(configuration.OUTBOX_MAX_BYTES)
+	var err error
+	deadLetters, err = outbox.Open(filepath.Join(configuration.OUTBOX_DIR, outboxDeadLetterDir), outboxOptions())
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(configuration.OUTBOX_DIR, outboxConnectionsDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	connOutboxesLock.Lock()
+	defer connOutboxesLock.Unlock()
+	for _, entry := range entries {
+		key, ok := parseConnOutboxDir(entry.Name())
+		if !entry.IsDir() || !ok {
+			continue
+		}
+		if _, err := openConnOutbox(key); err != nil {
+			return err
+		}
+	}
+	outboxEnabled = true
+	return nil
+}
+
+// openConnOutbox returns the outbox of the connection, opening it and starting its replay loop if needed,
+// it must be called while holding the outboxes lock
+func openConnOutbox(key connpool.Key) (*connOutbox, error) {
+	if co, ok := connOutboxes[key]; ok {
+		return co, nil
+	}
+	co := &connOutbox{key: key, dir: connOutboxDir(key)}
+	ob, err := outbox.Open(co.dir, outboxOptions())
+	if err != nil {
+		return nil, err
+	}
+	co.ob = ob
+	connOutboxes[key] = co
+	go replayConnOutbox(co)
+	return co, nil
+}
+
+// outboxPending reports whether messages of the user are waiting to be replayed, new messages are then stored behind them to keep their order
+func outboxPending(userData models.AuthSchema) bool {
+	if !outboxEnabled {
+		return false
+	}
+	connOutboxesLock.Lock()
+	co, ok := connOutboxes[ConnectionKey(int(userData.AccountId), userData.Username)]
+	connOutboxesLock.Unlock()
+	if !ok {
+		return false
+	}
+	records, _ := co.ob.Depth()
+	return records > 0
+}
+
+func storeInOutbox(userData models.AuthSchema, stationName, producerName string, msg batchMessage) error {
+	credentials, err := sealCredentials(userData.Password, userData.ConnectionToken)
+	if err != nil {
+		return err
+	}
+	hdrs, partitionKey, err := resolveProduceOpts(msg.opts)
+	if err != nil {
+		return err
+	}
+	record, err := json.Marshal(outboxEntry{
+		StationName:  stationName,
+		ProducerName: producerName,
+		Username:     userData.Username,
+		AccountId:    userData.AccountId,
+		Credentials:  credentials,
+		Payload:      msg.payload,
+		Headers:      hdrs.MsgHeaders,
+		MsgId:        msg.msgId,
+		PartitionKey: partitionKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	connOutboxesLock.Lock()
+	co, err := openConnOutbox(ConnectionKey(int(userData.AccountId), userData.Username))
+	if err != nil {
+		connOutboxesLock.Unlock()
+		return err
+	}
+	co.writers++
+	connOutboxesLock.Unlock()
+	err = co.ob.Append(record)
+	connOutboxesLock.Lock()
+	co.writers--
+	connOutboxesLock.Unlock()
+	return err
+}
+
+// respondQueued stores a message in the outbox and answers with 202 Accepted, the message is produced once the broker is reachable
+func respondQueued(c *fiber.Ctx, userData models.AuthSchema, stationName, producerName string, msg batchMessage) error {
+	log := logger.GetLogger(c)
+	if err := storeInOutbox(userData, stationName, producerName, msg); err != nil {
+		if errors.Is(err, outbox.ErrFull) {
+			log.Warnf("CreateHandleMessage - outbox: %s", err.Error())
+			setRetryAfter(c)
+			c.Status(fiber.StatusServiceUnavailable)
+		} else {
+			log.Errorf("CreateHandleMessage - outbox: %s", err.Error())
+			c.Status(fiber.StatusInternalServerError)
+		}
+		return c.JSON(&fiber.Map{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+	c.Status(fiber.StatusAccepted)
+	return c.JSON(&fiber.Map{
+		"success": true,
+		"error":   nil,
+		"queued":  true,
+	})
+}
+
+// queueBatchInOutbox stores the messages in the outbox in their order and records the result of every message by its index
+func queueBatchInOutbox(log *logger.Logger, userData models.AuthSchema, stationName, producerName string, batch []batchMessage, results []batchResult) {
+	for _, msg := range batch {
+		if err := storeInOutbox(userData, stationName, producerName, msg); err != nil {
+			log.Errorf("CreateHandleBatch - outbox: %s", err.Error())
+			results[msg.index] = batchResult{Index: msg.index, Status: batchResultBrokerError, Error: err.Error()}
+			continue
+		}
+		results[msg.index] = batchResult{Index: msg.index, Status: batchResultQueued}
+	}
+}
+
+func replayOutboxEntry(entry outboxEntry) error {
+	password, connectionToken, err := OpenCredentials(entry.Credentials)
+	if err != nil {
+		return errOutboxCredentials
+	}
+	conn, release, err := getUserConnection(models.AuthSchema{
+		Username:        entry.Username,
+		Password:        password,
+		ConnectionToken: connectionToken,
+		AccountId:       entry.AccountId,
+		TokenExpiry:     time.Now().Add(time.Duration(configuration.JWT_EXPIRES_IN_MINUTES) * time.Minute).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	defer release()
+	hdrs := memphis.Headers{MsgHeaders: entry.Headers}
+	if hdrs.MsgHeaders == nil {
+		hdrs.New()
+	}
+	opts := []memphis.ProduceOpt{memphis.MsgHeaders(hdrs)}
+	if entry.PartitionKey != "" {
+		opts = append(opts, memphis.ProducerPartitionKey(entry.PartitionKey))
+	}
+	return produceSync(conn, entry.StationName, entry.ProducerName, entry.Payload, opts...)
+}
+
+// isPermanentOutboxError reports whether producing the message can never succeed, other errors are retried
+func isPermanentOutboxError(err error) bool {
+	if errors.Is(err, errOutboxCredentials) || errors.Is(err, nats.ErrMaxPayload) || isAuthError(err) {
+		return true
+	}
+	errMsg := strings.ToLower(err.Error())
+	return strings.Contains(errMsg, "schema validation") || strings.Contains(errMsg, "maximum payload") || strings.Contains(errMsg, "permissions violation")
+}
+
+// moveToDeadLetters stores a message that can never be produced, it is dropped when the dead letters are full since keeping
+// it in the outbox of its connection would hold back the other messages while taking the same space
+func moveToDeadLetters(record []byte, reason error) error {
+	data, err := json.Marshal(deadLetter{Error: reason.Error(), FailedAt: time.Now(), Record: record})
+	if err != nil {
+		return err
+	}
+	err = deadLetters.Append(data)
+	if errors.Is(err, outbox.ErrFull) {
+		outboxLog.Errorf("ReplayOutbox - the outbox is full, dropping a message instead of moving it to the dead letters: %s", reason.Error())
+		return nil
+	}
+	return err
+}
+
+// replayConnOutbox produces the stored messages of a connection one by one in the order they were accepted, a message that
+// can not be produced because the broker is still unreachable is retried with a backoff, and one that can never be produced
+// (e.g. fails schema validation) is moved to the dead letters. The outbox is removed once it is empty
+func replayConnOutbox(co *connOutbox) {
+	log := outboxLog
+	backoff := time.Second
+	retry := func(format string, args ...any) {
+		log.Warnf(format, args...)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+	for {
+		record, err := co.ob.Peek()
+		if errors.Is(err, outbox.ErrEmpty) {
+			if closeConnOutbox(co) {
+				return
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if err != nil {
+			retry("ReplayOutbox: %s", err.Error())
+			continue
+		}
+		var entry outboxEntry
+		if err := json.Unmarshal(record, &entry); err != nil {
+			log.Errorf("ReplayOutbox - moving an invalid message to the dead letters: %s", err.Error())
+			if err := moveToDeadLetters(record, err); err != nil {
+				retry("ReplayOutbox - dead letters: %s", err.Error())
+				continue
+			}
+		} else if err := replayOutboxEntry(entry); err != nil {
+			if !isPermanentOutboxError(err) {
+				retry("ReplayOutbox - the broker is unavailable, retrying in %s: %s", backoff, err.Error())
+				continue
+			}
+			log.Errorf("ReplayOutbox - moving a message of station %s to the dead letters: %s", entry.StationName, err.Error())
+			if err := moveToDeadLetters(record, err); err != nil {
+				retry("ReplayOutbox - dead letters: %s", err.Error())
+				continue
+			}
+		}
+		backoff = time.Second
+		if err := co.ob.Commit(); err != nil {
+			log.Errorf("ReplayOutbox - commit: %s", err.Error())
+		}
+	}
+}
+
+// closeConnOutbox closes and removes the outbox of a connection once it is empty and no request is appending to it
+func closeConnOutbox(co *connOutbox) bool {
+	connOutboxesLock.Lock()
+	defer connOutboxesLock.Unlock()
+	if records, _ := co.ob.Depth(); records > 0 || co.writers > 0 {
+		return false
+	}
+	delete(connOutboxes, co.key)
+	if err := co.ob.Close(); err != nil {
+		outboxLog.Errorf("ReplayOutbox - close: %s", err.Error())
+	}
+	if err := os.RemoveAll(co.dir); err != nil {
+		outboxLog.Errorf("ReplayOutbox - remove: %s", err.Error())
+	}
+	return true
+}
+
+// outboxStatus returns the depth of the outboxes for the monitoring endpoints
+func outboxStatus() fiber.Map {
+	records, size := 0, int64(0)
+	connOutboxesLock.Lock()
+	connections := len(connOutboxes)
+	for _, co := range connOutboxes {
+		coRecords, coSize := co.ob.Depth()
+		records += coRecords
+		size += coSize
+	}
+	connOutboxesLock.Unlock()
+	deadLetterRecords, _ := deadLetters.Depth()
+	return fiber.Map{
+		"messages":     records,
+		"bytes":        size,
+		"connections":  connections,
+		"dead_letters": deadLetterRecords,
+	}
+}
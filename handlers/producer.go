@@ -3,16 +3,101 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
-	"strconv"
+	"fmt"
 
 	"rest-gateway/logger"
 	"rest-gateway/models"
 	"strings"
+	"sync"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/memphisdev/memphis.go"
 )
 
+const envelopeContentType = "application/vnd.memphis.envelope+json"
+
+type batchEnvelope struct {
+	Payload      json.RawMessage   `json:"payload"`
+	Headers      map[string]string `json:"headers"`
+	MsgId        string            `json:"msg_id"`
+	PartitionKey string            `json:"partition_key"`
+}
+
+const (
+	batchResultOk          = "ok"
+	batchResultInvalid     = "invalid"
+	batchResultSkipped     = "skipped"
+	batchResultSchemaError = "schema_error"
+	batchResultBrokerError = "broker_error"
+)
+
+type batchMessage struct {
+	index   int
+	payload []byte
+	msgId   string
+	opts    []memphis.ProduceOpt
+}
+
+type batchResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func copyHeaders(hdrs memphis.Headers) memphis.Headers {
+	cp := memphis.Headers{}
+	cp.New()
+	for key, value := range hdrs.MsgHeaders {
+		cp.MsgHeaders[key] = value
+	}
+	return cp
+}
+
+// envelopeMessage maps an envelope into a message with its own headers, msg id and partition key,
+// the request headers are kept as defaults which the envelope headers override
+func envelopeMessage(envelope batchEnvelope, requestHdrs memphis.Headers) (batchMessage, error) {
+	if len(envelope.Payload) == 0 {
+		return batchMessage{}, errors.New("payload is required")
+	}
+	payload := []byte(envelope.Payload)
+	var text string
+	if err := json.Unmarshal(envelope.Payload, &text); err == nil {
+		payload = []byte(text)
+	}
+	hdrs := copyHeaders(requestHdrs)
+	for key, value := range envelope.Headers {
+		if err := hdrs.Add(key, value); err != nil {
+			return batchMessage{}, err
+		}
+	}
+	opts := []memphis.ProduceOpt{memphis.MsgHeaders(hdrs)}
+	if envelope.MsgId != "" {
+		opts = append(opts, memphis.MsgId(envelope.MsgId))
+	}
+	if envelope.PartitionKey != "" {
+		opts = append(opts, memphis.ProducerPartitionKey(envelope.PartitionKey))
+	}
+	return batchMessage{payload: payload, msgId: envelope.MsgId, opts: opts}, nil
+}
+
+// isContentTypeAllowed checks the media type against the configured allowlist, which supports type/* wildcards
+func isContentTypeAllowed(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "" {
+		return false
+	}
+	for _, allowed := range configuration.PRODUCE_CONTENT_TYPES {
+		allowed = strings.ToLower(strings.Trim(allowed, `"`)) // list items set through env vars keep their json quotes
+		if allowed == "*/*" || allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
 func handleHeaders(headers map[string][]string) (memphis.Headers, error) {
 	hdrs := memphis.Headers{}
 	hdrs.New()
@@ -30,87 +115,97 @@ func CreateHandleMessage() func(*fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		log := logger.GetLogger(c)
 		// We do this parse to params instead of use fiber because there is a memory leak error in fiber
-		// stationName := c.Params("stationName")
-		url := c.Request().URI().String()
-		urlParts := strings.Split(url, "/")
-		stationName := urlParts[4]
+		stationName := StationName(c)
 		bodyReq := c.Body()
 		headers := c.GetReqHeaders()
+		msgId := extractMsgId(headers)
 		contentType := string(c.Request().Header.ContentType())
-		caseText := strings.Contains(contentType, "text")
-		caseJson := strings.Contains(contentType, "application/json")
-		if caseText {
-			contentType = "text/"
-		} else if caseJson {
-			contentType = "application/json"
+		if !isContentTypeAllowed(contentType) {
+			c.Status(fiber.StatusUnsupportedMediaType)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   fmt.Sprintf("unsupported content type %s", contentType),
+			})
 		}
 
-		switch contentType {
-		case "application/json", "text/", "application/x-protobuf":
-			message := bodyReq
-			hdrs, err := handleHeaders(headers)
-			if err != nil {
-				log.Errorf("CreateHandleMessage - handleHeaders: %s", err.Error())
-				c.Status(fiber.StatusInternalServerError)
-				return c.JSON(&fiber.Map{
-					"success": false,
-					"error":   "Server error",
+		name, err := producerName(c.Get(producerNameHeader), c.Query("producer_name"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		message := bodyReq
+		// the payload is produced as is, the Content-Type header copied along with the others lets consumers decode it
+		hdrs, err := handleHeaders(headers)
+		if err != nil {
+			log.Errorf("CreateHandleMessage - handleHeaders: %s", err.Error())
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "Server error",
+			})
+		}
+		userData, ok := c.Locals("userData").(models.AuthSchema)
+		if !ok {
+			log.Errorf("CreateHandleMessage: failed to get the user data from the middleware")
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "Server error",
+			})
+		}
+		produceOpts := []memphis.ProduceOpt{memphis.MsgHeaders(hdrs)}
+		if msgId != "" {
+			produceOpts = append(produceOpts, memphis.MsgId(msgId))
+		}
+		if outboxPending(userData) {
+			return respondQueued(c, userData, stationName, name, batchMessage{payload: message, msgId: msgId, opts: produceOpts})
+		}
+		conn, release, err := getUserConnection(userData)
+		if err != nil {
+			if isAuthError(err) {
+				log.Warnf("Could not establish new connection with the broker: Authentication error")
+				return c.Status(401).JSON(fiber.Map{
+					"message": "Unauthorized",
 				})
 			}
-			userData, ok := c.Locals("userData").(models.AuthSchema)
-			if !ok {
-				log.Errorf("CreateHandleMessage: failed to get the user data from the middleware")
-				c.Status(fiber.StatusInternalServerError)
-				return c.JSON(&fiber.Map{
-					"success": false,
-					"error":   "Server error",
-				})
+			if outboxEnabled {
+				log.Warnf("Could not establish new connection with the broker, storing the message in the outbox: %s", err.Error())
+				return respondQueued(c, userData, stationName, name, batchMessage{payload: message, msgId: msgId, opts: produceOpts})
 			}
-			username := userData.Username
-			accountId := userData.AccountId
-			accountIdStr := strconv.Itoa(int(accountId))
-			conn := ConnectionsCache[accountIdStr][username].Connection
-			if conn == nil {
-				conn, err = Connect(userData.Password, username, userData.ConnectionToken, int(accountId))
-				if err != nil {
-					errMsg := strings.ToLower(err.Error())
-					if strings.Contains(errMsg, ErrorMsgAuthorizationViolation) || strings.Contains(errMsg, "token") || strings.Contains(errMsg, ErrorMsgMissionAccountId) {
-						log.Warnf("Could not establish new connection with the broker: Authentication error")
-						return c.Status(401).JSON(fiber.Map{
-							"message": "Unauthorized",
-						})
-					}
-
-					log.Errorf("Could not establish new connection with the broker: %s", err.Error())
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"message": "Server error",
-					})
-				}
-				if ConnectionsCache[accountIdStr] == nil {
-					ConnectionsCacheLock.Lock()
-					ConnectionsCache[accountIdStr] = make(map[string]Connection)
-					ConnectionsCacheLock.Unlock()
-				}
 
-				ConnectionsCacheLock.Lock()
-				ConnectionsCache[accountIdStr][username] = Connection{Connection: conn, ExpirationTime: userData.TokenExpiry}
-				ConnectionsCacheLock.Unlock()
-			}
-			err = conn.Produce(stationName, "rest-gateway", message, []memphis.ProducerOpt{}, []memphis.ProduceOpt{memphis.MsgHeaders(hdrs)})
-			if err != nil {
-				if !strings.Contains(strings.ToLower(err.Error()), "schema validation") {
-					log.Errorf("CreateHandleMessage - produce: %s", err.Error())
-					c.Status(fiber.StatusInternalServerError)
-				} else {
-					c.Status(fiber.StatusBadRequest)
-				}
-				return c.JSON(&fiber.Map{
-					"success": false,
-					"error":   err.Error(),
-				})
+			log.Errorf("Could not establish new connection with the broker: %s", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"message": "Server error",
+			})
+		}
+		defer release()
+		if c.Query("async") == "true" {
+			return respondAsync(c, userData, stationName, name, []batchMessage{{payload: message, msgId: msgId, opts: produceOpts}}, nil)
+		}
+		// waiting for the broker acknowledgement lets a message that did not land be stored in the outbox
+		err = produceSync(conn, stationName, name, message, produceOpts...)
+		if err != nil && outboxEnabled && isBrokerUnavailable(conn, err) {
+			log.Warnf("CreateHandleMessage - the broker is unavailable, storing the message in the outbox: %s", err.Error())
+			return respondQueued(c, userData, stationName, name, batchMessage{payload: message, msgId: msgId, opts: produceOpts})
+		}
+		if err != nil {
+			if errors.Is(err, errTooManyProducers) {
+				log.Warnf("CreateHandleMessage - produce: %s", err.Error())
+				c.Status(fiber.StatusTooManyRequests)
+			} else if !strings.Contains(strings.ToLower(err.Error()), "schema validation") {
+				log.Errorf("CreateHandleMessage - produce: %s", err.Error())
+				c.Status(fiber.StatusInternalServerError)
+			} else {
+				c.Status(fiber.StatusBadRequest)
 			}
-		default:
-			return errors.New("unsupported content type")
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
 		}
 
 		c.Status(200)
@@ -125,22 +220,22 @@ func CreateHandleBatch() func(*fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		log := logger.GetLogger(c)
 		// We do this parse to params instead of use fiber because there is a memory leak error in fiber
-		// stationName := c.Params("stationName")
-		url := c.Request().URI().String()
-		urlParts := strings.Split(url, "/")
-		stationName := urlParts[4]
+		stationName := StationName(c)
 		bodyReq := c.Body()
 		headers := c.GetReqHeaders()
+		batchMsgId := extractMsgId(headers)
 		contentType := string(c.Request().Header.ContentType())
+		name, err := producerName(c.Get(producerNameHeader), c.Query("producer_name"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
 
 		switch contentType {
-		case "application/json":
-			var batchReq []map[string]any
-			err := json.Unmarshal(bodyReq, &batchReq)
-			if err != nil {
-				log.Errorf("CreateHandleBatch - body unmarshal: %s", err.Error())
-				return errors.New("unsupported request")
-			}
+		case "application/json", envelopeContentType:
 			hdrs, err := handleHeaders(headers)
 			if err != nil {
 				log.Errorf("CreateHandleBatch - handleHeaders: %s", err.Error())
@@ -151,6 +246,69 @@ func CreateHandleBatch() func(*fiber.Ctx) error {
 				})
 			}
 
+			errCount := 0
+			var allErr []string
+			var batch []batchMessage
+			var results []batchResult
+			if contentType == envelopeContentType || c.Query("envelope") == "true" {
+				var batchReq []batchEnvelope
+				err := json.Unmarshal(bodyReq, &batchReq)
+				if err != nil {
+					log.Errorf("CreateHandleBatch - body unmarshal: %s", err.Error())
+					return errors.New("unsupported request")
+				}
+				results = make([]batchResult, len(batchReq))
+				for i, envelope := range batchReq {
+					msg, err := envelopeMessage(envelope, hdrs)
+					if err != nil {
+						errCount++
+						allErr = append(allErr, err.Error())
+						results[i] = batchResult{Index: i, Status: batchResultInvalid, Error: err.Error()}
+						continue
+					}
+					msg.index = i
+					batch = append(batch, msg)
+				}
+			} else {
+				var batchReq []map[string]any
+				err := json.Unmarshal(bodyReq, &batchReq)
+				if err != nil {
+					log.Errorf("CreateHandleBatch - body unmarshal: %s", err.Error())
+					return errors.New("unsupported request")
+				}
+				results = make([]batchResult, len(batchReq))
+				for i, msg := range batchReq {
+					rawRes, err := json.Marshal(msg)
+					if err != nil {
+						errCount++
+						allErr = append(allErr, err.Error())
+						results[i] = batchResult{Index: i, Status: batchResultInvalid, Error: err.Error()}
+						continue
+					}
+					if batchMsgId == "" {
+						batch = append(batch, batchMessage{index: i, payload: rawRes, opts: []memphis.ProduceOpt{memphis.MsgHeaders(copyHeaders(hdrs))}})
+						continue
+					}
+					// every message of the batch gets its own msg id derived from the request's idempotency key
+					msgId := fmt.Sprintf("%s-%d", batchMsgId, i)
+					batch = append(batch, batchMessage{index: i, payload: rawRes, msgId: msgId, opts: []memphis.ProduceOpt{memphis.MsgHeaders(copyHeaders(hdrs)), memphis.MsgId(msgId)}})
+				}
+			}
+			// atomic only covers the messages rejected by the gateway, the schema is validated by the sdk while producing
+			if errCount > 0 && c.Query("atomic") == "true" {
+				for _, msg := range batch {
+					results[msg.index] = batchResult{Index: msg.index, Status: batchResultSkipped}
+				}
+				c.Status(fiber.StatusBadRequest)
+				return c.JSON(&fiber.Map{
+					"success": false,
+					"sent":    0,
+					"fail":    errCount,
+					"errors":  allErr,
+					"results": results,
+				})
+			}
+
 			userData, ok := c.Locals("userData").(models.AuthSchema)
 			if !ok {
 				log.Errorf("CreateHandleBatch: failed to get the user data from the middleware")
@@ -161,79 +319,131 @@ func CreateHandleBatch() func(*fiber.Ctx) error {
 				})
 			}
 
-			username := userData.Username
-			accountId := userData.AccountId
-			accountIdStr := strconv.Itoa(int(accountId))
-			conn := ConnectionsCache[accountIdStr][username].Connection
-			if conn == nil {
-				conn, err = Connect(userData.Password, username, userData.ConnectionToken, int(accountId))
+			var conn *memphis.Conn
+			var release func()
+			queue := outboxPending(userData)
+			if !queue {
+				conn, release, err = getUserConnection(userData)
 				if err != nil {
-					errMsg := strings.ToLower(err.Error())
-					if strings.Contains(errMsg, ErrorMsgAuthorizationViolation) || strings.Contains(errMsg, "token") || strings.Contains(errMsg, ErrorMsgMissionAccountId) {
+					if isAuthError(err) {
 						log.Warnf("Could not establish new connection with the broker: Authentication error")
 						return c.Status(401).JSON(fiber.Map{
 							"message": "Unauthorized",
 						})
 					}
-
-					log.Errorf("Could not establish new connection with the broker: %s", err.Error())
-					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-						"message": "Server error",
-					})
-				}
-				if ConnectionsCache[accountIdStr] == nil {
-					ConnectionsCacheLock.Lock()
-					ConnectionsCache[accountIdStr] = make(map[string]Connection)
-					ConnectionsCacheLock.Unlock()
+					if !outboxEnabled {
+						log.Errorf("Could not establish new connection with the broker: %s", err.Error())
+						return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+							"message": "Server error",
+						})
+					}
+					log.Warnf("Could not establish new connection with the broker, storing the messages in the outbox: %s", err.Error())
+					queue = true
+				} else {
+					defer release()
 				}
-
-				ConnectionsCacheLock.Lock()
-				ConnectionsCache[accountIdStr][username] = Connection{Connection: conn, ExpirationTime: userData.TokenExpiry}
-				ConnectionsCacheLock.Unlock()
 			}
 
-			errCount := 0
-			var allErr []string
-			for _, msg := range batchReq {
-				rawRes, err := json.Marshal(msg)
-				if err != nil {
-					errCount++
-					allErr = append(allErr, err.Error())
-					continue
+			if queue {
+				queueBatchInOutbox(log, userData, stationName, name, batch, results)
+			} else {
+				if c.Query("async") == "true" {
+					return respondAsync(c, userData, stationName, name, batch, allErr)
 				}
-				if err := conn.Produce(stationName, "rest-gateway", rawRes, []memphis.ProducerOpt{}, []memphis.ProduceOpt{memphis.MsgHeaders(hdrs)}); err != nil {
-					if !strings.Contains(strings.ToLower(err.Error()), "schema validation") {
-						log.Errorf("CreateHandleBatch - produce: %s", err.Error())
-						c.Status(fiber.StatusInternalServerError)
-					} else {
-						c.Status(fiber.StatusBadRequest)
+				produceBatch(log, conn, stationName, name, batch, results)
+				if outboxEnabled {
+					unavailable := []batchMessage{}
+					for _, msg := range batch {
+						if result := results[msg.index]; result.Status == batchResultBrokerError && isBrokerUnavailable(conn, errors.New(result.Error)) {
+							unavailable = append(unavailable, msg)
+						}
+					}
+					queueBatchInOutbox(log, userData, stationName, name, unavailable, results)
+				}
+			}
+			sent, queued, brokerErrors := 0, 0, 0
+			for _, msg := range batch {
+				switch result := results[msg.index]; result.Status {
+				case batchResultOk:
+					sent++
+				case batchResultQueued:
+					queued++
+				default:
+					if result.Status == batchResultBrokerError {
+						brokerErrors++
 					}
 					errCount++
-					allErr = append(allErr, err.Error())
-					return c.JSON(&fiber.Map{
-						"success": false,
-						"error":   allErr,
-					})
+					allErr = append(allErr, result.Error)
 				}
 			}
 
 			if errCount > 0 {
-				c.Status(400)
-				return c.JSON(&fiber.Map{
+				c.Status(fiber.StatusBadRequest)
+				if brokerErrors > 0 {
+					c.Status(fiber.StatusInternalServerError)
+				}
+				res := fiber.Map{
 					"success": false,
-					"sent":    len(batchReq) - errCount,
+					"sent":    sent,
 					"fail":    errCount,
 					"errors":  allErr,
-				})
+					"results": results,
+				}
+				if queued > 0 {
+					res["queued"] = queued
+				}
+				return c.JSON(&res)
+			}
+
+			res := fiber.Map{
+				"success": true,
+				"error":   nil,
+				"results": results,
+			}
+			c.Status(200)
+			if queued > 0 {
+				// the queued messages are produced once the broker is reachable again
+				res["queued"] = queued
+				c.Status(fiber.StatusAccepted)
 			}
+			return c.JSON(&res)
 		default:
 			return errors.New("unsupported content type")
 		}
+	}
+}
 
-		c.Status(200)
-		return c.JSON(&fiber.Map{
-			"success": true,
-			"error":   nil,
-		})
+// produceBatch produces the messages concurrently, up to BATCH_PRODUCE_MAX_IN_FLIGHT at a time, and records the result of every message by its index
+func produceBatch(log *logger.Logger, conn *memphis.Conn, stationName, name string, batch []batchMessage, results []batchResult) {
+	maxInFlight := configuration.BATCH_PRODUCE_MAX_IN_FLIGHT
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+	inFlight := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+	for _, msg := range batch {
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func(msg batchMessage) {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			results[msg.index] = produceBatchMessage(log, conn, stationName, name, msg)
+		}(msg)
+	}
+	wg.Wait()
+}
+
+func produceBatchMessage(log *logger.Logger, conn *memphis.Conn, stationName, name string, msg batchMessage) batchResult {
+	// waiting for the broker acknowledgement tells which messages have landed
+	err := produceSync(conn, stationName, name, msg.payload, msg.opts...)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "schema validation") {
+			return batchResult{Index: msg.index, Status: batchResultSchemaError, Error: err.Error()}
+		}
+		log.Errorf("CreateHandleBatch - produce: %s", err.Error())
+		return batchResult{Index: msg.index, Status: batchResultBrokerError, Error: err.Error()}
 	}
+	return batchResult{Index: msg.index, Status: batchResultOk}
 }
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"errors"
+	"regexp"
+	"rest-gateway/connpool"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/memphisdev/memphis.go"
+)
+
+const (
+	defaultProducerName = "rest-gateway"
+	producerNameHeader  = "X-Producer-Name"
+)
+
+var producerNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9_.-]{0,126}[a-z0-9])?$`)
+
+type producerKey struct {
+	stationName string
+	name        string
+}
+
+type cachedProducer struct {
+	producer *memphis.Producer
+	lastUsed time.Time
+	inUse    int  // number of requests currently producing with the producer
+	removed  bool // no longer cached, destroyed once the last request is done with it
+}
+
+// connProducers holds the producers created over a connection, creations and destructions are serialized per connection
+// since the sdk does not support creating producers concurrently over the same connection and hands out its cached
+// instance of a producer that is still being destroyed
+type connProducers struct {
+	createLock sync.Mutex
+	producers  map[producerKey]*cachedProducer
+	creating   int // requests creating a producer or waiting for the create lock, the connection is kept meanwhile
+}
+
+var producersLock sync.Mutex
+var producers = map[*memphis.Conn]*connProducers{}
+
+var errTooManyProducers = errors.New("too many producers over the connection, please reuse producer names or retry once idle producers are released")
+
+func init() {
+	Connections.OnEvict(func(_ connpool.Key, conn *memphis.Conn) {
+		releaseProducers(conn)
+	})
+}
+
+// producerName returns the producer name requested through the X-Producer-Name header or the producer_name query param,
+// the requests without one are produced by the rest-gateway producer
+func producerName(header, query string) (string, error) {
+	name := header
+	if name == "" {
+		name = query
+	}
+	if name == "" {
+		return defaultProducerName, nil
+	}
+	name = strings.ToLower(name)
+	if !producerNameRegex.MatchString(name) {
+		return "", errors.New("producer name can contain up to 128 lowercase letters, digits, '_', '-' and '.' and should start and end with a letter or a digit")
+	}
+	return name, nil
+}
+
+// lookupProducer returns the cached producer marked as in use, it must be called while holding the producers lock
+func lookupProducer(cp *connProducers, key producerKey) (*cachedProducer, bool) {
+	p, ok := cp.producers[key]
+	if !ok {
+		return nil, false
+	}
+	p.lastUsed = time.Now()
+	p.inUse++
+	return p, true
+}
+
+// getProducer returns the cached producer of the station marked as in use, the producer is created on first use
+// and has to be handed back with putProducer
+func getProducer(conn *memphis.Conn, stationName, name string) (*connProducers, *cachedProducer, error) {
+	key := producerKey{stationName: stationName, name: name}
+	producersLock.Lock()
+	cp, ok := producers[conn]
+	if !ok {
+		cp = &connProducers{producers: map[producerKey]*cachedProducer{}}
+		producers[conn] = cp
+	}
+	p, ok := lookupProducer(cp, key)
+	if ok {
+		producersLock.Unlock()
+		return cp, p, nil
+	}
+	cp.creating++
+	producersLock.Unlock()
+	defer func() {
+		producersLock.Lock()
+		cp.creating--
+		producersLock.Unlock()
+	}()
+
+	cp.createLock.Lock()
+	defer cp.createLock.Unlock()
+	producersLock.Lock()
+	p, ok = lookupProducer(cp, key) // created while waiting for the lock
+	full := configuration.MAX_PRODUCERS_PER_CONNECTION > 0 && len(cp.producers) >= configuration.MAX_PRODUCERS_PER_CONNECTION
+	producersLock.Unlock()
+	if ok {
+		return cp, p, nil
+	}
+	if full {
+		return nil, nil, errTooManyProducers
+	}
+	producer, err := conn.CreateProducer(stationName, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	p = &cachedProducer{producer: producer, lastUsed: time.Now(), inUse: 1}
+	producersLock.Lock()
+	if producers[conn] == cp { // the connection may have been evicted meanwhile
+		cp.producers[key] = p
+	} else {
+		p.removed = true
+	}
+	producersLock.Unlock()
+	return cp, p, nil
+}
+
+// putProducer hands back a producer taken with getProducer, a producer which failed to produce is removed from the cache
+// so the next request creates a new one, and is destroyed once no other request is producing with it
+func putProducer(cp *connProducers, stationName, name string, p *cachedProducer, failed bool) {
+	producersLock.Lock()
+	if !failed && !p.removed {
+		p.inUse--
+		producersLock.Unlock()
+		return
+	}
+	producersLock.Unlock()
+
+	// the producer is destroyed while holding the create lock, otherwise a concurrent creation could get
+	// the sdk's cached instance of the producer that is being destroyed
+	cp.createLock.Lock()
+	defer cp.createLock.Unlock()
+	key := producerKey{stationName: stationName, name: name}
+	producersLock.Lock()
+	p.inUse--
+	if failed && cp.producers[key] == p {
+		delete(cp.producers, key)
+		p.removed = true
+	}
+	destroy := p.removed && p.inUse == 0
+	producersLock.Unlock()
+	if destroy {
+		p.producer.Destroy()
+	}
+}
+
+// produce produces the message using the cached producer of the station
+func produce(conn *memphis.Conn, stationName, name string, message any, opts ...memphis.ProduceOpt) error {
+	cp, p, err := getProducer(conn, stationName, name)
+	if err != nil {
+		return err
+	}
+	err = p.producer.Produce(message, opts...)
+	putProducer(cp, stationName, name, p, err != nil && !strings.Contains(strings.ToLower(err.Error()), "schema validation"))
+	return err
+}
+
+// produceSync produces the message and waits for the broker acknowledgement, a message with an id is deduplicated by the broker
+// within the station's idempotency window, the sdk does not tell whether it was a duplicate so it is not reported
+func produceSync(conn *memphis.Conn, stationName, name string, message []byte, opts ...memphis.ProduceOpt) error {
+	return produce(conn, stationName, name, message, append(opts[:len(opts):len(opts)], memphis.SyncProduce())...)
+}
+
+// releaseProducers drops the producers of a connection that is about to be closed, the broker removes them with the connection
+func releaseProducers(conn *memphis.Conn) {
+	producersLock.Lock()
+	defer producersLock.Unlock()
+	delete(producers, conn)
+}
+
+type idleProducer struct {
+	cp  *connProducers
+	key producerKey
+	p   *cachedProducer
+}
+
+// CleanIdleProducers destroys the producers which were not used for the idle timeout, producers in use are kept
+func CleanIdleProducers() {
+	for range time.Tick(time.Second * 30) {
+		idleTimeout := time.Duration(configuration.PRODUCER_IDLE_TIMEOUT_SECONDS) * time.Second
+		now := time.Now()
+		idle := []idleProducer{}
+		producersLock.Lock()
+		for conn, cp := range producers {
+			for key, p := range cp.producers {
+				if p.inUse == 0 && now.Sub(p.lastUsed) > idleTimeout {
+					idle = append(idle, idleProducer{cp: cp, key: key, p: p})
+				}
+			}
+			if len(cp.producers) == 0 && cp.creating == 0 {
+				delete(producers, conn)
+			}
+		}
+		producersLock.Unlock()
+
+		for _, ip := range idle {
+			destroyIdleProducer(ip, idleTimeout)
+		}
+	}
+}
+
+func destroyIdleProducer(ip idleProducer, idleTimeout time.Duration) {
+	ip.cp.createLock.Lock()
+	defer ip.cp.createLock.Unlock()
+	producersLock.Lock()
+	idle := ip.cp.producers[ip.key] == ip.p && ip.p.inUse == 0 && time.Since(ip.p.lastUsed) > idleTimeout // may have been used meanwhile
+	if idle {
+		delete(ip.cp.producers, ip.key)
+		ip.p.removed = true
+	}
+	producersLock.Unlock()
+	if idle {
+		ip.p.producer.Destroy()
+	}
+}
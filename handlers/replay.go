@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/memphisdev/memphis.go"
+	"github.com/nats-io/nats.go"
+)
+
+const maxDeletedMsgsProbe = 100
+
+var errConsumerGroupExists = errors.New("the consumer group already exists, a start position can only be set when the consumer group is created")
+
+func fetchStartConsumeFromSequence(seq uint64) memphis.FetchOpt {
+	return func(opts *memphis.FetchOpts) error {
+		opts.StartConsumeFromSequence = seq
+		return nil
+	}
+}
+
+func fetchLastMessages(lastMessages int64) memphis.FetchOpt {
+	return func(opts *memphis.FetchOpts) error {
+		opts.LastMessages = lastMessages
+		return nil
+	}
+}
+
+// stationStreamName returns the name of the stream which holds the station's messages,
+// for partitioned stations the first partition is used
+func stationStreamName(js nats.JetStreamContext, stationName string) (string, nats.StreamState, error) {
+	internalName := strings.ReplaceAll(strings.ToLower(stationName), ".", "#")
+	for _, streamName := range []string{internalName + "$1", internalName} {
+		info, err := js.StreamInfo(streamName)
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", nats.StreamState{}, err
+		}
+		return streamName, info.State, nil
+	}
+	return "", nats.StreamState{}, errors.New("station " + stationName + " does not exist")
+}
+
+// msgTimeAtOrAfter returns the sequence and time of the first message stored at or after the given sequence
+func msgTimeAtOrAfter(js nats.JetStreamContext, streamName string, seq, lastSeq uint64) (uint64, time.Time, error) {
+	for probe := 0; seq <= lastSeq && probe < maxDeletedMsgsProbe; probe++ {
+		msg, err := js.GetMsg(streamName, seq)
+		if err == nil {
+			return seq, msg.Time, nil
+		}
+		if !errors.Is(err, nats.ErrMsgNotFound) {
+			return 0, time.Time{}, err
+		}
+		seq++
+	}
+	return 0, time.Time{}, nats.ErrMsgNotFound
+}
+
+// ensureNewConsumerGroup returns errConsumerGroupExists in case the consumer group was already created on the station,
+// its start position is then fixed and a requested one would be ignored
+func ensureNewConsumerGroup(js nats.JetStreamContext, stationName, consumerGroup string) error {
+	streamName, _, err := stationStreamName(js, stationName)
+	if err != nil {
+		return err
+	}
+	durable := strings.ReplaceAll(strings.ToLower(consumerGroup), ".", "#")
+	_, err = js.ConsumerInfo(streamName, durable)
+	if err == nil {
+		return errConsumerGroupExists
+	}
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return nil
+	}
+	return err
+}
+
+// sequenceForTime binary searches the station's stream for the first message stored at or after startTime
+func sequenceForTime(js nats.JetStreamContext, stationName string, startTime time.Time) (uint64, error) {
+	streamName, state, err := stationStreamName(js, stationName)
+	if err != nil {
+		return 0, err
+	}
+	if state.Msgs == 0 {
+		return state.LastSeq + 1, nil
+	}
+
+	lo, hi := state.FirstSeq, state.LastSeq+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		seq, msgTime, err := msgTimeAtOrAfter(js, streamName, mid, state.LastSeq)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			hi = mid
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if msgTime.Before(startTime) {
+			lo = seq + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
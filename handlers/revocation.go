@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"rest-gateway/logger"
+	"rest-gateway/memphisSingleton"
+	"rest-gateway/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/nats-io/nats.go"
+)
+
+const revocationsBucket = "rest_gw_revocations"
+
+// a revocation either denies a single token or a token family until they expire,
+// or denies all the tokens of a user that were issued before the revocation
+type revocation struct {
+	TokenId   string  `json:"token_id,omitempty"`
+	FamilyId  string  `json:"family_id,omitempty"`
+	ExpiresAt int64   `json:"expires_at,omitempty"`
+	Username  string  `json:"username"`
+	AccountId float64 `json:"account_id"`
+	RevokedAt int64   `json:"revoked_at"`
+}
+
+func (r revocation) key() string {
+	if r.TokenId != "" {
+		return "token." + r.TokenId
+	}
+	if r.FamilyId != "" {
+		return "family." + r.FamilyId
+	}
+	return userRevocationKey(r.AccountId, r.Username)
+}
+
+var revokedTokens = map[string]int64{}   // token id to its expiration
+var revokedFamilies = map[string]int64{} // token family id to the expiration of its latest token
+var revokedUsers = map[string]int64{}    // user to the time its tokens were revoked
+var revocationsLock sync.RWMutex
+
+func userRevocationKey(accountId float64, username string) string {
+	return fmt.Sprintf("user.%d.%s", int(accountId), hex.EncodeToString([]byte(strings.ToLower(username))))
+}
+
+// IsTokenRevoked reports whether the token was logged out or revoked by an admin
+func IsTokenRevoked(userData models.AuthSchema) bool {
+	revocationsLock.RLock()
+	defer revocationsLock.RUnlock()
+	if _, ok := revokedTokens[userData.TokenId]; ok && userData.TokenId != "" {
+		return true
+	}
+	if _, ok := revokedFamilies[userData.TokenFamilyId]; ok && userData.TokenFamilyId != "" {
+		return true
+	}
+	revokedAt, ok := revokedUsers[userRevocationKey(userData.AccountId, userData.Username)]
+	return ok && userData.TokenIssuedAt <= revokedAt
+}
+
+func applyRevocation(r revocation) {
+	storeRevocation(r)
+	closeUserConnection(r.AccountId, r.Username)
+	stopRevokedSubscriptions()
+}
+
+func storeRevocation(r revocation) {
+	revocationsLock.Lock()
+	defer revocationsLock.Unlock()
+	switch {
+	case r.TokenId != "":
+		revokedTokens[r.TokenId] = r.ExpiresAt
+	case r.FamilyId != "":
+		revokedFamilies[r.FamilyId] = r.ExpiresAt
+	default:
+		revokedUsers[userRevocationKey(r.AccountId, r.Username)] = r.RevokedAt
+	}
+}
+
+func closeUserConnection(accountId float64, username string) {
+	Connections.Remove(ConnectionKey(int(accountId), username))
+}
+
+// revoke applies the revocation, persists it for gateways that start later and broadcasts it to the running ones
+func revoke(r revocation) error {
+	r.RevokedAt = time.Now().Unix()
+	applyRevocation(r)
+
+	revocationBytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	kv, err := memphisSingleton.GetKeyValueStore(revocationsBucket)
+	if err != nil {
+		return err
+	}
+	if _, err := kv.Put(r.key(), revocationBytes); err != nil {
+		return err
+	}
+
+	mc, err := memphisSingleton.GetMemphisConnection("", "", "") // already initialized on logger creation
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(models.RestGwUpdate{Type: "revoke_token", Update: map[string]interface{}{"revocation": r}})
+	if err != nil {
+		return err
+	}
+	return mc.Publish(configuration.REST_GW_UPDATES_SUBJ, msg)
+}
+
+func handleRevocationUpdate(log *logger.Logger, update models.RestGwUpdate) {
+	revocationBytes, err := json.Marshal(update.Update["revocation"])
+	if err != nil {
+		log.Errorf("ListenForUpdates - revocation: %s", err.Error())
+		return
+	}
+	var r revocation
+	if err := json.Unmarshal(revocationBytes, &r); err != nil {
+		log.Errorf("ListenForUpdates - revocation: %s", err.Error())
+		return
+	}
+	applyRevocation(r)
+}
+
+// LoadRevocations loads the revocations made by any of the gateways so far
+func LoadRevocations() error {
+	kv, err := memphisSingleton.GetKeyValueStore(revocationsBucket)
+	if err != nil {
+		return err
+	}
+	keys, err := kv.Keys()
+	if err != nil {
+		if errors.Is(err, nats.ErrNoKeysFound) {
+			return nil
+		}
+		return err
+	}
+	for _, key := range keys {
+		entry, err := kv.Get(key)
+		if err != nil {
+			if errors.Is(err, nats.ErrKeyNotFound) {
+				continue
+			}
+			return err
+		}
+		var r revocation
+		if err := json.Unmarshal(entry.Value(), &r); err != nil {
+			return err
+		}
+		storeRevocation(r)
+	}
+	return nil
+}
+
+// CleanRevokedTokens drops the revoked token and family ids once the tokens have expired anyway
+func CleanRevokedTokens() {
+	for range time.Tick(time.Minute) {
+		now := time.Now().Unix()
+		expired := []string{}
+		revocationsLock.Lock()
+		for tokenId, expiresAt := range revokedTokens {
+			if now > expiresAt {
+				delete(revokedTokens, tokenId)
+				expired = append(expired, "token."+tokenId)
+			}
+		}
+		for familyId, expiresAt := range revokedFamilies {
+			if now > expiresAt {
+				delete(revokedFamilies, familyId)
+				expired = append(expired, "family."+familyId)
+			}
+		}
+		revocationsLock.Unlock()
+
+		if len(expired) == 0 {
+			continue
+		}
+		kv, err := memphisSingleton.GetKeyValueStore(revocationsBucket)
+		if err != nil {
+			continue
+		}
+		for _, key := range expired {
+			kv.Delete(key) // may have already been deleted by another gateway
+		}
+	}
+}
+
+// parseGatewayToken verifies an access or refresh token issued by the gateways
+func parseGatewayToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, AccessTokenKey)
+	if err != nil {
+		token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return []byte(configuration.REFRESH_JWT_SECRET), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func tokenRevocation(claims jwt.MapClaims) (revocation, error) {
+	tokenId, _ := claims["jti"].(string)
+	username, _ := claims["username"].(string)
+	exp, _ := claims["exp"].(float64)
+	accountId, _ := claims["account_id"].(float64)
+	if tokenId == "" || username == "" {
+		return revocation{}, errors.New("the token has no id and can not be revoked")
+	}
+	if !configuration.USER_PASS_BASED_AUTH {
+		accountId = 1
+	}
+	return revocation{TokenId: tokenId, ExpiresAt: int64(exp), Username: username, AccountId: accountId}, nil
+}
+
+func (ah AuthHandler) Logout(c *fiber.Ctx) error {
+	log := logger.GetLogger(c)
+	var body models.RefreshTokenSchema
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			log.Warnf("Logout: %s", err.Error())
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"message": "Invalid request body",
+			})
+		}
+	}
+	userData, ok := c.Locals("userData").(models.AuthSchema)
+	if !ok {
+		log.Errorf("Logout: failed to get the user data from the middleware")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	if userData.TokenId == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"message": "The token has no id and can not be revoked",
+		})
+	}
+
+	revocations := []revocation{{TokenId: userData.TokenId, ExpiresAt: userData.TokenExpiry, Username: userData.Username, AccountId: userData.AccountId}}
+	if body.JwtRefreshToken != "" {
+		claims, err := parseGatewayToken(body.JwtRefreshToken)
+		if err == nil {
+			var r revocation
+			r, err = tokenRevocation(claims)
+			if err == nil && (r.AccountId != userData.AccountId || !strings.EqualFold(r.Username, userData.Username)) {
+				err = errors.New("the refresh token belongs to another user")
+			}
+			revocations = append(revocations, r)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"message": "Invalid refresh token",
+			})
+		}
+	}
+
+	for _, r := range revocations {
+		if err := revoke(r); err != nil {
+			log.Errorf("Logout: %s", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"message": "Server error",
+			})
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+func (ah AuthHandler) RevokeToken(c *fiber.Ctx) error {
+	log := logger.GetLogger(c)
+	var body models.RevokeTokenSchema
+	if err := c.BodyParser(&body); err != nil {
+		log.Warnf("RevokeToken: %s", err.Error())
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"message": "Invalid request body",
+		})
+	}
+
+	var r revocation
+	switch {
+	case body.Token != "":
+		claims, err := parseGatewayToken(body.Token)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"message": "Invalid token",
+			})
+		}
+		r, err = tokenRevocation(claims)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"message": err.Error(),
+			})
+		}
+	case body.Username != "":
+		if body.AccountId == 0 {
+			body.AccountId = 1
+		}
+		r = revocation{Username: strings.ToLower(body.Username), AccountId: body.AccountId}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"message": "Either token or username is required",
+		})
+	}
+
+	if err := revoke(r); err != nil {
+		log.Errorf("RevokeToken: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+	})
+}
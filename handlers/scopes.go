@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"fmt"
+	"path"
+	"rest-gateway/models"
+	"strings"
+)
+
+const (
+	ScopeProduce = "produce"
+	ScopeConsume = "consume"
+)
+
+// validateScopes checks that every scope is an <action>:<station pattern> pair, e.g. produce:orders.* or *:audit
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		action, pattern, found := strings.Cut(scope, ":")
+		if !found || pattern == "" {
+			return fmt.Errorf("invalid scope %s, expected <action>:<station pattern>", scope)
+		}
+		if action != ScopeProduce && action != ScopeConsume && action != "*" {
+			return fmt.Errorf("invalid scope %s, supported actions are produce, consume and *", scope)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid scope %s: %s", scope, err.Error())
+		}
+	}
+	return nil
+}
+
+// HasScope reports whether the user may perform the action on the station, tokens issued without scopes are not restricted
+func HasScope(userData models.AuthSchema, action, stationName string) bool {
+	if len(userData.Scopes) == 0 {
+		return true
+	}
+	stationName = strings.ToLower(stationName)
+	for _, scope := range userData.Scopes {
+		scopeAction, pattern, _ := strings.Cut(scope, ":")
+		if scopeAction != action && scopeAction != "*" {
+			continue
+		}
+		if matched, _ := path.Match(strings.ToLower(pattern), stationName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopeError describes why a request was rejected by the token scopes
+func ScopeError(action, stationName string) error {
+	preposition := "to"
+	if action == ScopeConsume {
+		preposition = "from"
+	}
+	return fmt.Errorf("The token is not allowed to %s %s station %s", action, preposition, stationName)
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"os"
+	"rest-gateway/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSignatureToleranceSeconds = 300
+
+// by station name and account, stations of different accounts may share a name
+var signatureVerifiers = map[string]map[float64]models.SignatureVerifier{}
+
+// signatureVerifiersLoadedAt stands for the time the signed requests were issued, so once the user of a verifier is revoked
+// the verifier is rejected until its configuration is loaded again
+var signatureVerifiersLoadedAt int64
+
+// LoadSignatureVerifiers loads the verifiers of the stations that accept signed webhooks,
+// the github and stripe schemes fill in the defaults of the respective providers
+func LoadSignatureVerifiers() error {
+	if configuration.SIGNATURE_VERIFIERS_PATH == "" {
+		return nil
+	}
+	verifiersBytes, err := os.ReadFile(configuration.SIGNATURE_VERIFIERS_PATH)
+	if err != nil {
+		return err
+	}
+	var verifiers []models.SignatureVerifier
+	if err := json.Unmarshal(verifiersBytes, &verifiers); err != nil {
+		return err
+	}
+
+	for i, verifier := range verifiers {
+		switch verifier.Scheme {
+		case "github":
+			verifier.Header = defaultString(verifier.Header, "X-Hub-Signature-256")
+			verifier.Algorithm = defaultString(verifier.Algorithm, "sha256")
+			verifier.Prefix = defaultString(verifier.Prefix, verifier.Algorithm+"=")
+			verifier.TimestampHeader = ""
+		case "stripe":
+			verifier.Header = defaultString(verifier.Header, "Stripe-Signature")
+			verifier.Algorithm = "sha256"
+		case "hmac":
+			if verifier.Header == "" {
+				return fmt.Errorf("verifier %d: header is required", i)
+			}
+			if verifier.TimestampHeader == "" {
+				return fmt.Errorf("verifier %d: timestamp_header is required, without a signed timestamp a captured request could be replayed", i)
+			}
+			verifier.Algorithm = defaultString(verifier.Algorithm, "sha256")
+		default:
+			return fmt.Errorf("verifier %d: unsupported scheme %s, supported schemes are github, stripe and hmac", i, verifier.Scheme)
+		}
+		verifier.Encoding = defaultString(verifier.Encoding, "hex")
+		if verifier.ToleranceSeconds <= 0 {
+			verifier.ToleranceSeconds = defaultSignatureToleranceSeconds
+		}
+		if verifier.AccountId == 0 {
+			verifier.AccountId = 1
+		}
+		if verifier.StationName == "" || verifier.Secret == "" || verifier.Username == "" {
+			return fmt.Errorf("verifier %d: station_name, secret and username are required", i)
+		}
+		if _, err := signatureHash(verifier.Algorithm); err != nil {
+			return fmt.Errorf("verifier %d: %s", i, err.Error())
+		}
+		if verifier.Encoding != "hex" && verifier.Encoding != "base64" {
+			return fmt.Errorf("verifier %d: unsupported encoding %s, supported encodings are hex and base64", i, verifier.Encoding)
+		}
+		verifier.StationName = strings.ToLower(verifier.StationName)
+		verifier.Username = strings.ToLower(verifier.Username)
+		if _, ok := signatureVerifiers[verifier.StationName]; !ok {
+			signatureVerifiers[verifier.StationName] = map[float64]models.SignatureVerifier{}
+		}
+		if _, ok := signatureVerifiers[verifier.StationName][verifier.AccountId]; ok {
+			return fmt.Errorf("verifier %d: station %s of account %d already has a verifier", i, verifier.StationName, int(verifier.AccountId))
+		}
+		signatureVerifiers[verifier.StationName][verifier.AccountId] = verifier
+	}
+	signatureVerifiersLoadedAt = time.Now().Unix()
+	return nil
+}
+
+func defaultString(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func signatureHash(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s, supported algorithms are sha1, sha256 and sha512", algorithm)
+}
+
+// SignatureVerifiersFor returns the verifiers of the stations named stationName in any account whose signature header
+// the request carries, the signature tells which one the request is meant for
+func SignatureVerifiersFor(stationName string, header func(string) string) []models.SignatureVerifier {
+	verifiers := []models.SignatureVerifier{}
+	for _, verifier := range signatureVerifiers[strings.ToLower(stationName)] {
+		if header(verifier.Header) != "" {
+			verifiers = append(verifiers, verifier)
+		}
+	}
+	return verifiers
+}
+
+// VerifySignature checks the request signature and returns the user the station's webhooks are produced as
+func VerifySignature(verifier models.SignatureVerifier, header func(string) string, body []byte) (models.AuthSchema, error) {
+	signatureHeader := header(verifier.Header)
+	timestamp := ""
+	signatures := []string{}
+	switch verifier.Scheme {
+	case "stripe":
+		// t=<timestamp>,v1=<signature>[,v1=<signature>]
+		for _, part := range strings.Split(signatureHeader, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch key {
+			case "t":
+				timestamp = value
+			case "v1":
+				signatures = append(signatures, value)
+			}
+		}
+		if timestamp == "" {
+			return models.AuthSchema{}, errors.New("missing signature timestamp")
+		}
+	default:
+		if !strings.HasPrefix(signatureHeader, verifier.Prefix) {
+			return models.AuthSchema{}, errors.New("malformed signature")
+		}
+		signatures = append(signatures, strings.TrimPrefix(signatureHeader, verifier.Prefix))
+		if verifier.TimestampHeader != "" {
+			timestamp = header(verifier.TimestampHeader)
+			if timestamp == "" {
+				return models.AuthSchema{}, errors.New("missing signature timestamp")
+			}
+		}
+	}
+
+	if timestamp != "" {
+		signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return models.AuthSchema{}, errors.New("invalid signature timestamp")
+		}
+		if math.Abs(float64(time.Now().Unix()-signedAt)) > float64(verifier.ToleranceSeconds) {
+			return models.AuthSchema{}, errors.New("signature timestamp is outside the tolerance")
+		}
+	}
+
+	hashFunc, err := signatureHash(verifier.Algorithm)
+	if err != nil {
+		return models.AuthSchema{}, err
+	}
+	mac := hmac.New(hashFunc, []byte(verifier.Secret))
+	if timestamp != "" {
+		mac.Write([]byte(timestamp))
+		mac.Write([]byte("."))
+	}
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		var decoded []byte
+		if verifier.Encoding == "base64" {
+			decoded, err = base64.StdEncoding.DecodeString(signature)
+		} else {
+			decoded, err = hex.DecodeString(signature)
+		}
+		if err == nil && hmac.Equal(decoded, expected) {
+			return models.AuthSchema{
+				Username:        verifier.Username,
+				Password:        verifier.Password,
+				ConnectionToken: verifier.ConnectionToken,
+				AccountId:       verifier.AccountId,
+				TokenExpiry:     time.Now().Add(time.Duration(configuration.JWT_EXPIRES_IN_MINUTES) * time.Minute).Unix(),
+				Scopes:          []string{ScopeProduce + ":" + verifier.StationName},
+				TokenIssuedAt:   signatureVerifiersLoadedAt,
+			}, nil
+		}
+	}
+	return models.AuthSchema{}, errors.New("signature mismatch")
+}
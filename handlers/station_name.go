@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const stationNameLocal = "stationName"
+
+var errInvalidStationName = errors.New("invalid station name")
+
+// ParseStationName returns the station name of a /stations/<station name>/... path, names which could be decoded or
+// normalized into another station (escaped characters, slashes or dot segments) are rejected so the scopes, the rate
+// limits and the handlers all act on the same station
+func ParseStationName(path string) (string, error) {
+	pathParts := strings.Split(path, "/")
+	if len(pathParts) < 3 || !strings.EqualFold(pathParts[1], "stations") {
+		return "", errInvalidStationName
+	}
+	stationName := pathParts[2]
+	if stationName == "" || stationName == "." || strings.ContainsAny(stationName, "/%\\") || strings.Contains(stationName, "..") {
+		return "", errInvalidStationName
+	}
+	return stationName, nil
+}
+
+// SetStationName stores the station name of the request for the middlewares and handlers that follow
+func SetStationName(c *fiber.Ctx, stationName string) {
+	c.Locals(stationNameLocal, stationName)
+}
+
+// StationName returns the station name the request was resolved to, it is empty for requests not targeting a station
+func StationName(c *fiber.Ctx) string {
+	stationName, _ := c.Locals(stationNameLocal).(string)
+	return stationName
+}
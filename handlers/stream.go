@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"rest-gateway/logger"
+	"rest-gateway/models"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/memphisdev/memphis.go"
+)
+
+const streamKeepAliveInterval = 15 * time.Second
+
+type streamEvent struct {
+	consumedMessage
+	Sequence uint64 `json:"sequence"`
+}
+
+func streamConsumerName(consumerName string) (string, error) {
+	// every stream gets its own consumer inside the consumer group, so that closing one stream does not affect the others
+	suffix, err := generateRandomId()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", consumerName, suffix[:8]), nil
+}
+
+func ConsumeStreamHandleMessages() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		log := logger.GetLogger(c)
+		stationName := StationName(c)
+		reqBody := requestBody{}
+		err := c.QueryParser(&reqBody)
+		if err != nil {
+			log.Errorf("ConsumeStreamHandleMessages - parse query params: %s", err.Error())
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "Invalid query params",
+			})
+		}
+		if reqBody.ConsumerName == "" {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "Consumer name is required",
+			})
+		}
+		if !isValidEncoding(reqBody.Encoding) {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "Unsupported encoding, supported encodings are utf8, base64 and json",
+			})
+		}
+		userData, ok := c.Locals("userData").(models.AuthSchema)
+		if !ok {
+			log.Errorf("ConsumeStreamHandleMessages: failed to get the user data from the middleware")
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   "Server error",
+			})
+		}
+		conn, release, err := getUserConnection(userData)
+		if err != nil {
+			if isAuthError(err) {
+				log.Warnf("Could not establish new connection with the broker: Authentication error")
+				return c.Status(401).JSON(fiber.Map{
+					"message": "Unauthorized",
+				})
+			}
+
+			log.Errorf("Could not establish new connection with the broker: %s", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"message": "Server error",
+			})
+		}
+		streaming := false
+		defer func() {
+			if !streaming {
+				release() // otherwise the connection is released once the stream ends
+			}
+		}()
+
+		reqBody.initializeDefaults()
+		consumerName, err := streamConsumerName(reqBody.ConsumerName)
+		if err != nil {
+			log.Errorf("ConsumeStreamHandleMessages - consumer name: %s", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"message": "Server error",
+			})
+		}
+		consumer, err := conn.CreateConsumer(stationName, consumerName,
+			memphis.ConsumerGroup(reqBody.ConsumerGroup),
+			memphis.BatchSize(reqBody.BatchSize),
+			memphis.BatchMaxWaitTime(time.Duration(reqBody.BatchMaxWaitTimeMs)*time.Millisecond),
+			memphis.PullInterval(100*time.Millisecond))
+		if err != nil {
+			log.Errorf("ConsumeStreamHandleMessages - create consumer: %s", err.Error())
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(&fiber.Map{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+
+		msgsCh := make(chan *memphis.Msg, reqBody.BatchSize)
+		done := make(chan struct{})
+		err = consumer.Consume(func(msgs []*memphis.Msg, err error, ctx context.Context) {
+			if err != nil {
+				return
+			}
+			for _, msg := range msgs {
+				select {
+				case msgsCh <- msg:
+				case <-done:
+					return
+				}
+			}
+		})
+		if err != nil {
+			log.Errorf("ConsumeStreamHandleMessages - consume: %s", err.Error())
+			consumer.Destroy()
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"message": "Server error",
+			})
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Set("X-Accel-Buffering", "no")
+		streaming = true
+		c.Status(fiber.StatusOK).Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer func() {
+				close(done)
+				if err := consumer.Destroy(); err != nil {
+					log.Errorf("ConsumeStreamHandleMessages - destroy consumer: %s", err.Error())
+				}
+				release()
+			}()
+
+			keepAlive := time.NewTicker(streamKeepAliveInterval)
+			defer keepAlive.Stop()
+			fmt.Fprintf(w, ": connected to station %s\n\n", stationName)
+			if err := w.Flush(); err != nil {
+				return
+			}
+			for {
+				select {
+				case msg := <-msgsCh:
+					seq, _ := msg.GetSequenceNumber()
+					data, err := json.Marshal(streamEvent{
+						consumedMessage: newConsumedMessage(msg.Data(), msg.GetHeaders(), reqBody.Encoding),
+						Sequence:        seq,
+					})
+					if err != nil {
+						log.Errorf("ConsumeStreamHandleMessages - marshal event: %s", err.Error())
+						continue
+					}
+					fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", seq, data)
+					if err := w.Flush(); err != nil {
+						return // client disconnected, the unacked message will be redelivered
+					}
+					if err := msg.Ack(); err != nil {
+						log.Errorf("ConsumeStreamHandleMessages - acknowledge message: %s", err.Error())
+					}
+				case <-keepAlive.C:
+					fmt.Fprint(w, ": keep-alive\n\n")
+					if err := w.Flush(); err != nil {
+						return
+					}
+				}
+			}
+		})
+		return nil
+	}
+}
@@ -0,0 +1,557 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"rest-gateway/logger"
+	"rest-gateway/memphisSingleton"
+	"rest-gateway/models"
+	"rest-gateway/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/memphisdev/memphis.go"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	subscriptionsBucket      = "rest_gw_subscriptions"
+	webhookSignatureHeader   = "X-Memphis-Signature"
+	webhookTimestampHeader   = "X-Memphis-Timestamp"
+	webhookSubscriptionIdHdr = "X-Memphis-Subscription-Id"
+	webhookMaxBackoff        = 30 * time.Second
+)
+
+type SubscriptionsHandler struct{}
+
+type webhookMessage struct {
+	Message  any               `json:"message"`
+	Headers  map[string]string `json:"headers"`
+	Encoding string            `json:"encoding,omitempty"`
+	Sequence uint64            `json:"sequence"`
+}
+
+type webhookPayload struct {
+	SubscriptionId string           `json:"subscription_id"`
+	StationName    string           `json:"station_name"`
+	Messages       []webhookMessage `json:"messages"`
+}
+
+type subscriptionWorker struct {
+	sub    models.Subscription
+	cancel context.CancelFunc
+}
+
+// every gateway runs a worker per subscription, the workers share the subscription's consumer group
+// so each message is delivered by a single gateway
+var subscriptionWorkers = map[string]subscriptionWorker{}
+var subscriptionWorkersLock sync.Mutex
+var subscriptionsLog *logger.Logger
+
+var webhookClient = newWebhookClient()
+
+func publicSubscription(sub models.Subscription) models.Subscription {
+	sub.Secret = ""
+	sub.SealedSecret = ""
+	sub.Credentials = ""
+	sub.TokenId = ""
+	sub.TokenFamilyId = ""
+	sub.TokenIssuedAt = 0
+	return sub
+}
+
+// subscriptionUser returns the identity the subscription was created with, so the revocations of its token or user apply to it
+func subscriptionUser(sub models.Subscription) models.AuthSchema {
+	return models.AuthSchema{
+		Username:      sub.Username,
+		AccountId:     sub.AccountId,
+		TokenId:       sub.TokenId,
+		TokenFamilyId: sub.TokenFamilyId,
+		TokenIssuedAt: sub.TokenIssuedAt,
+	}
+}
+
+// subscriptionEnded returns why the subscription may no longer deliver messages, a subscription lasts as long as
+// the credentials it was created with
+func subscriptionEnded(sub models.Subscription) error {
+	if IsTokenRevoked(subscriptionUser(sub)) {
+		return errors.New("the credentials it was created with were revoked")
+	}
+	if sub.ExpiresAt > 0 && time.Now().Unix() > sub.ExpiresAt {
+		return errors.New("the credentials it was created with have expired")
+	}
+	return nil
+}
+
+// endSubscription removes a subscription which may no longer deliver messages, the workers of all the gateways
+// are stopped once its removal is watched
+func endSubscription(log *logger.Logger, sub models.Subscription, reason error) {
+	log.Warnf("Subscription %s - removing the subscription since %s", sub.Id, reason.Error())
+	kv, err := memphisSingleton.GetKeyValueStore(subscriptionsBucket)
+	if err == nil {
+		err = kv.Delete(sub.Id)
+	}
+	if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+		log.Errorf("Subscription %s - remove: %s", sub.Id, err.Error())
+	}
+}
+
+// stopRevokedSubscriptions stops right away the workers of the subscriptions whose credentials were revoked
+func stopRevokedSubscriptions() {
+	ended := []models.Subscription{}
+	subscriptionWorkersLock.Lock()
+	for id, worker := range subscriptionWorkers {
+		if IsTokenRevoked(subscriptionUser(worker.sub)) {
+			worker.cancel()
+			delete(subscriptionWorkers, id)
+			ended = append(ended, worker.sub)
+		}
+	}
+	subscriptionWorkersLock.Unlock()
+	for _, sub := range ended {
+		endSubscription(subscriptionsLog, sub, errors.New("the credentials it was created with were revoked"))
+	}
+}
+
+func (sh SubscriptionsHandler) CreateSubscription(c *fiber.Ctx) error {
+	log := logger.GetLogger(c)
+	var body models.CreateSubscriptionSchema
+	if err := c.BodyParser(&body); err != nil {
+		log.Warnf("CreateSubscription: %s", err.Error())
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"message": "Invalid request body",
+		})
+	}
+	if err := utils.Validate(body); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"message": err,
+		})
+	}
+	userData, ok := c.Locals("userData").(models.AuthSchema)
+	if !ok {
+		log.Errorf("CreateSubscription: failed to get the user data from the middleware")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+
+	if !HasScope(userData, ScopeConsume, body.StationName) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"message": ScopeError(ScopeConsume, body.StationName).Error(),
+		})
+	}
+	if err := validateWebhookTarget(c.Context(), body.TargetUrl); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"message": err.Error(),
+		})
+	}
+
+	id, err := generateRandomId()
+	if err != nil {
+		log.Errorf("CreateSubscription: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	if body.Secret == "" {
+		body.Secret, err = generateRandomId()
+		if err != nil {
+			log.Errorf("CreateSubscription: %s", err.Error())
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"message": "Server error",
+			})
+		}
+	}
+	if body.ConsumerGroup == "" {
+		body.ConsumerGroup = fmt.Sprintf("webhook-%s-rest-gateway", id[:8])
+	} else {
+		body.ConsumerGroup = fmt.Sprintf("%s-rest-gateway", body.ConsumerGroup)
+	}
+	if body.BatchSize <= 0 {
+		body.BatchSize = 1
+	}
+	if body.MaxRetries <= 0 {
+		body.MaxRetries = configuration.WEBHOOK_MAX_RETRIES
+	}
+	if !isValidEncoding(body.Encoding) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"message": "Unsupported encoding, supported encodings are utf8, base64 and json",
+		})
+	}
+
+	credentials, err := sealCredentials(userData.Password, userData.ConnectionToken)
+	if err != nil {
+		log.Errorf("CreateSubscription: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	sealedSecret, err := sealSecret(body.Secret)
+	if err != nil {
+		log.Errorf("CreateSubscription: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+
+	sub := models.Subscription{
+		Id:            id,
+		StationName:   body.StationName,
+		ConsumerGroup: body.ConsumerGroup,
+		TargetUrl:     body.TargetUrl,
+		BatchSize:     body.BatchSize,
+		MaxRetries:    body.MaxRetries,
+		Encoding:      body.Encoding,
+		SealedSecret:  sealedSecret,
+		Username:      userData.Username,
+		AccountId:     userData.AccountId,
+		Credentials:   credentials,
+		TokenId:       userData.TokenId,
+		TokenFamilyId: userData.TokenFamilyId,
+		TokenIssuedAt: userData.TokenIssuedAt,
+		ExpiresAt:     userData.CredentialsExpiry,
+		CreatedAt:     time.Now(),
+	}
+	if err := storeSubscription(sub); err != nil {
+		log.Errorf("CreateSubscription: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+
+	res := publicSubscription(sub)
+	res.Secret = body.Secret // the secret is only returned once, on creation
+	return c.Status(fiber.StatusCreated).JSON(res)
+}
+
+func (sh SubscriptionsHandler) ListSubscriptions(c *fiber.Ctx) error {
+	log := logger.GetLogger(c)
+	userData, ok := c.Locals("userData").(models.AuthSchema)
+	if !ok {
+		log.Errorf("ListSubscriptions: failed to get the user data from the middleware")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	subs, err := getSubscriptions()
+	if err != nil {
+		log.Errorf("ListSubscriptions: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	res := []models.Subscription{}
+	for _, sub := range subs {
+		if sub.AccountId == userData.AccountId && strings.EqualFold(sub.Username, userData.Username) {
+			res = append(res, publicSubscription(sub))
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(res)
+}
+
+func (sh SubscriptionsHandler) DeleteSubscription(c *fiber.Ctx) error {
+	log := logger.GetLogger(c)
+	id := c.Params("id")
+	userData, ok := c.Locals("userData").(models.AuthSchema)
+	if !ok {
+		log.Errorf("DeleteSubscription: failed to get the user data from the middleware")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	kv, err := memphisSingleton.GetKeyValueStore(subscriptionsBucket)
+	if err != nil {
+		log.Errorf("DeleteSubscription: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	entry, err := kv.Get(id)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"message": "Subscription not found",
+			})
+		}
+		log.Errorf("DeleteSubscription: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	var sub models.Subscription
+	if err := json.Unmarshal(entry.Value(), &sub); err != nil || sub.AccountId != userData.AccountId || !strings.EqualFold(sub.Username, userData.Username) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"message": "Subscription not found",
+		})
+	}
+	if err := kv.Delete(id); err != nil {
+		log.Errorf("DeleteSubscription: %s", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"message": "Server error",
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"error":   nil,
+	})
+}
+
+func storeSubscription(sub models.Subscription) error {
+	kv, err := memphisSingleton.GetKeyValueStore(subscriptionsBucket)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(sub.Id, value)
+	return err
+}
+
+func getSubscriptions() ([]models.Subscription, error) {
+	kv, err := memphisSingleton.GetKeyValueStore(subscriptionsBucket)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := kv.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, err
+	}
+	subs := []models.Subscription{}
+	for _, key := range keys {
+		entry, err := kv.Get(key)
+		if err != nil {
+			continue
+		}
+		var sub models.Subscription
+		if err := json.Unmarshal(entry.Value(), &sub); err != nil {
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// ListenForSubscriptions watches the subscriptions bucket and starts/stops the delivery workers accordingly
+func ListenForSubscriptions(log *logger.Logger) error {
+	kv, err := memphisSingleton.GetKeyValueStore(subscriptionsBucket)
+	if err != nil {
+		return err
+	}
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		return err
+	}
+	subscriptionsLog = log
+
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry == nil { // all the existing subscriptions have been replayed
+				continue
+			}
+			id := entry.Key()
+			subscriptionWorkersLock.Lock()
+			if worker, ok := subscriptionWorkers[id]; ok {
+				worker.cancel()
+				delete(subscriptionWorkers, id)
+			}
+			if entry.Operation() == nats.KeyValuePut {
+				var sub models.Subscription
+				if err := json.Unmarshal(entry.Value(), &sub); err != nil {
+					log.Errorf("ListenForSubscriptions - subscription unmarshal: %s", err.Error())
+				} else {
+					ctx, cancel := context.WithCancel(context.Background())
+					subscriptionWorkers[id] = subscriptionWorker{sub: sub, cancel: cancel}
+					go runSubscription(ctx, log, sub)
+				}
+			}
+			subscriptionWorkersLock.Unlock()
+		}
+	}()
+	return nil
+}
+
+func webhookBackoff(attempt int) time.Duration {
+	backoff := time.Second << attempt
+	if backoff > webhookMaxBackoff || backoff <= 0 {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func runSubscription(ctx context.Context, log *logger.Logger, sub models.Subscription) {
+	var conn *memphis.Conn
+	var consumer *memphis.Consumer
+	defer func() {
+		if consumer != nil {
+			consumer.Destroy()
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	if err := subscriptionEnded(sub); err != nil {
+		endSubscription(log, sub, err)
+		return
+	}
+	secret, err := openSecret(sub.SealedSecret)
+	if err != nil {
+		log.Errorf("Subscription %s - failed to open the webhook secret: %s", sub.Id, err.Error())
+		return
+	}
+	sub.Secret = secret
+
+	// the messages must stay unacked for as long as all the delivery attempts may take
+	maxAckTime := time.Duration(sub.MaxRetries+1) * (webhookClient.Timeout + webhookMaxBackoff)
+	for attempt := 0; consumer == nil; attempt++ {
+		var err error
+		if conn == nil {
+			var password, connectionToken string
+			password, connectionToken, err = OpenCredentials(sub.Credentials)
+			if err == nil {
+				conn, err = Connect(password, sub.Username, connectionToken, int(sub.AccountId))
+			}
+		}
+		if err == nil {
+			var consumerName string
+			consumerName, err = streamConsumerName("rest-gateway-webhook")
+			if err == nil {
+				consumer, err = conn.CreateConsumer(sub.StationName, consumerName,
+					memphis.ConsumerGroup(sub.ConsumerGroup),
+					memphis.BatchSize(sub.BatchSize),
+					memphis.BatchMaxWaitTime(time.Second),
+					memphis.MaxAckTime(maxAckTime),
+					memphis.MaxMsgDeliveries(2))
+			}
+		}
+		if err != nil {
+			log.Errorf("Subscription %s - could not start consuming from station %s: %s", sub.Id, sub.StationName, err.Error())
+			if err := subscriptionEnded(sub); err != nil {
+				endSubscription(log, sub, err)
+				return
+			}
+			if !sleepWithContext(ctx, webhookBackoff(attempt)) {
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if err := subscriptionEnded(sub); err != nil {
+			endSubscription(log, sub, err)
+			return
+		}
+
+		msgs, err := consumer.Fetch(sub.BatchSize, false)
+		if err != nil {
+			log.Errorf("Subscription %s - fetch messages: %s", sub.Id, err.Error())
+			if !sleepWithContext(ctx, time.Second) {
+				return
+			}
+			continue
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+
+		err = deliverWebhook(ctx, sub, msgs)
+		for _, msg := range msgs {
+			if err == nil {
+				err := msg.Ack()
+				if err != nil {
+					log.Errorf("Subscription %s - acknowledge message: %s", sub.Id, err.Error())
+				}
+			} else if ctx.Err() == nil {
+				err := msg.DeadLetter("webhook delivery to " + sub.TargetUrl + " has failed: " + err.Error())
+				if err != nil {
+					log.Errorf("Subscription %s - dead letter message: %s", sub.Id, err.Error())
+				}
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Warnf("Subscription %s - %d messages were sent to the dead-letter station: %s", sub.Id, len(msgs), err.Error())
+		}
+	}
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliverWebhook(ctx context.Context, sub models.Subscription, msgs []*memphis.Msg) error {
+	payload := webhookPayload{
+		SubscriptionId: sub.Id,
+		StationName:    sub.StationName,
+		Messages:       make([]webhookMessage, 0, len(msgs)),
+	}
+	for _, msg := range msgs {
+		seq, _ := msg.GetSequenceNumber()
+		consumed := newConsumedMessage(msg.Data(), msg.GetHeaders(), sub.Encoding)
+		payload.Messages = append(payload.Messages, webhookMessage{
+			Message:  consumed.Message,
+			Headers:  consumed.Headers,
+			Encoding: consumed.Encoding,
+			Sequence: seq,
+		})
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.TargetUrl, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set(webhookSubscriptionIdHdr, sub.Id)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, signWebhook(sub.Secret, timestamp, body))
+
+		res, err := webhookClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode >= 200 && res.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("target responded with status %d", res.StatusCode)
+		}
+		if attempt >= sub.MaxRetries || !sleepWithContext(ctx, webhookBackoff(attempt)) {
+			return err
+		}
+	}
+}
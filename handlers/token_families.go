@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"rest-gateway/memphisSingleton"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const tokenFamiliesBucket = "rest_gw_token_families"
+
+var errRefreshTokenReused = errors.New("refresh token reuse detected")
+
+// all the tokens issued by refreshing the tokens of a single authentication share a family,
+// the family tracks the only refresh token that may still be used
+type tokenFamily struct {
+	RefreshTokenId string  `json:"refresh_token_id"`
+	Username       string  `json:"username"`
+	AccountId      float64 `json:"account_id"`
+	ExpiresAt      int64   `json:"expires_at"` // the latest expiration of any token in the family
+}
+
+// rotateTokenFamily makes the new refresh token the only valid one of its family, presenting a refresh token
+// that was already rotated means it has leaked so the whole family is revoked
+func rotateTokenFamily(familyId, previousRefreshTokenId string, family tokenFamily) error {
+	kv, err := memphisSingleton.GetKeyValueStore(tokenFamiliesBucket)
+	if err != nil {
+		return err
+	}
+	if previousRefreshTokenId == "" {
+		familyBytes, err := json.Marshal(family)
+		if err != nil {
+			return err
+		}
+		_, err = kv.Create(familyId, familyBytes)
+		return err
+	}
+
+	entry, err := kv.Get(familyId)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return errRefreshTokenReused // the family has expired or was revoked
+		}
+		return err
+	}
+	var current tokenFamily
+	if err := json.Unmarshal(entry.Value(), &current); err != nil {
+		return err
+	}
+	if current.ExpiresAt > family.ExpiresAt {
+		family.ExpiresAt = current.ExpiresAt
+	}
+	if current.RefreshTokenId != previousRefreshTokenId {
+		return revokeTokenFamily(familyId, family)
+	}
+
+	familyBytes, err := json.Marshal(family)
+	if err != nil {
+		return err
+	}
+	// a concurrent refresh using the same token makes the revision outdated
+	if _, err := kv.Update(familyId, familyBytes, entry.Revision()); err != nil {
+		if revokeErr := revokeTokenFamily(familyId, family); revokeErr != errRefreshTokenReused {
+			return revokeErr
+		}
+		return errRefreshTokenReused
+	}
+	return nil
+}
+
+func revokeTokenFamily(familyId string, family tokenFamily) error {
+	err := revoke(revocation{FamilyId: familyId, ExpiresAt: family.ExpiresAt, Username: family.Username, AccountId: family.AccountId})
+	if err != nil {
+		return err
+	}
+	return errRefreshTokenReused
+}
+
+// CleanTokenFamilies drops the families whose tokens have all expired
+func CleanTokenFamilies() {
+	for range time.Tick(10 * time.Minute) {
+		kv, err := memphisSingleton.GetKeyValueStore(tokenFamiliesBucket)
+		if err != nil {
+			continue
+		}
+		keys, err := kv.Keys()
+		if err != nil {
+			continue
+		}
+		now := time.Now().Unix()
+		for _, familyId := range keys {
+			entry, err := kv.Get(familyId)
+			if err != nil {
+				continue
+			}
+			var family tokenFamily
+			if err := json.Unmarshal(entry.Value(), &family); err == nil && now > family.ExpiresAt {
+				kv.Delete(familyId) // may have already been deleted by another gateway
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var errWebhookTargetNotAllowed = errors.New("the target url resolves to a loopback, private or link-local address")
+
+// the shared address space is used by some clouds for their metadata endpoints
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isWebhookAddressAllowed rejects the addresses a webhook could use to reach the gateway's own network,
+// e.g. the loopback interface or the cloud metadata endpoint, unless private targets are allowed
+func isWebhookAddressAllowed(ip net.IP) bool {
+	if configuration.WEBHOOK_ALLOW_PRIVATE_TARGETS {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// validateWebhookTarget checks that the target is an http(s) url whose host only resolves to allowed addresses
+func validateWebhookTarget(ctx context.Context, targetUrl string) error {
+	u, err := url.Parse(targetUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported target url scheme %s, supported schemes are http and https", u.Scheme)
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !isWebhookAddressAllowed(ip) {
+			return errWebhookTargetNotAllowed
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the target url host %s", host)
+	}
+	for _, addr := range addrs {
+		if !isWebhookAddressAllowed(addr.IP) {
+			return errWebhookTargetNotAllowed
+		}
+	}
+	return nil
+}
+
+// webhookDialControl checks the address every delivery actually connects to, so a host resolving
+// to another address after the subscription was created can't be used to reach the gateway's network
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isWebhookAddressAllowed(ip) {
+		return errWebhookTargetNotAllowed
+	}
+	return nil
+}
+
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: webhookDialControl}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // the target is the address being checked, not a proxy's
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: time.Duration(configuration.WEBHOOK_TIMEOUT_SECONDS) * time.Second, Transport: transport}
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"rest-gateway/logger"
+	"rest-gateway/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/memphisdev/memphis.go"
+)
+
+type wsClientFrame struct {
+	Action   string            `json:"action"`
+	Id       string            `json:"id"`
+	Message  json.RawMessage   `json:"message"`
+	Headers  map[string]string `json:"headers"`
+	AckToken string            `json:"ack_token"`
+}
+
+type wsServerFrame struct {
+	Type     string            `json:"type"`
+	Id       string            `json:"id,omitempty"`
+	Success  *bool             `json:"success,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Message  any               `json:"message,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Encoding string            `json:"encoding,omitempty"`
+	Sequence uint64            `json:"sequence,omitempty"`
+	AckToken string            `json:"ack_token,omitempty"`
+}
+
+type wsSession struct {
+	ws           *websocket.Conn
+	writeLock    sync.Mutex
+	log          *logger.Logger
+	conn         *memphis.Conn
+	stationName  string
+	producerName string
+	userData     models.AuthSchema
+}
+
+func (s *wsSession) send(frame wsServerFrame) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.ws.WriteJSON(frame)
+}
+
+func (s *wsSession) result(frameType, id string, err error) {
+	success := err == nil
+	frame := wsServerFrame{Type: frameType, Id: id, Success: &success}
+	if err != nil {
+		frame.Error = err.Error()
+	}
+	if err := s.send(frame); err != nil {
+		s.log.Warnf("WebSocketHandleMessages - send %s: %s", frameType, err.Error())
+	}
+}
+
+func (s *wsSession) produce(id string, message []byte, headers map[string]string) {
+	hdrs := memphis.Headers{}
+	hdrs.New()
+	for key, value := range headers {
+		if err := hdrs.Add(key, value); err != nil {
+			s.result("produce_ack", id, err)
+			return
+		}
+	}
+	err := produce(s.conn, s.stationName, s.producerName, message, memphis.MsgHeaders(hdrs))
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "schema validation") {
+		s.log.Errorf("WebSocketHandleMessages - produce: %s", err.Error())
+	}
+	s.result("produce_ack", id, err)
+}
+
+func (s *wsSession) settle(frame wsClientFrame) {
+	accountIdStr := strconv.Itoa(int(s.userData.AccountId))
+	reply, err := openAckToken(frame.AckToken, s.stationName, accountIdStr, s.userData.Username)
+	if err == nil {
+		var nc *userNatsConn
+		var release func()
+		nc, release, err = getUserNatsConn(s.userData)
+		if err == nil {
+			err = settleMessage(nc, reply, frame.Action)
+			release()
+		}
+	}
+	s.result(frame.Action+"_result", frame.Id, err)
+}
+
+func (s *wsSession) consume(reqBody requestBody, manualAck bool, done chan struct{}) (*memphis.Consumer, error) {
+	reqBody.initializeDefaults()
+	consumerName, err := streamConsumerName(reqBody.ConsumerName)
+	if err != nil {
+		return nil, err
+	}
+	opts := []memphis.ConsumerOpt{
+		memphis.ConsumerGroup(reqBody.ConsumerGroup),
+		memphis.BatchSize(reqBody.BatchSize),
+		memphis.BatchMaxWaitTime(time.Duration(reqBody.BatchMaxWaitTimeMs) * time.Millisecond),
+		memphis.PullInterval(100 * time.Millisecond),
+	}
+	if manualAck {
+		opts = append(opts, memphis.MaxAckTime(time.Duration(reqBody.AckDeadlineMs)*time.Millisecond), memphis.MaxMsgDeliveries(reqBody.MaxMsgDeliveries))
+	}
+	consumer, err := s.conn.CreateConsumer(s.stationName, consumerName, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	accountIdStr := strconv.Itoa(int(s.userData.AccountId))
+	err = consumer.Consume(func(msgs []*memphis.Msg, err error, ctx context.Context) {
+		if err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			seq, _ := msg.GetSequenceNumber()
+			consumed := newConsumedMessage(msg.Data(), msg.GetHeaders(), reqBody.Encoding)
+			frame := wsServerFrame{
+				Type:     "message",
+				Message:  consumed.Message,
+				Headers:  consumed.Headers,
+				Encoding: consumed.Encoding,
+				Sequence: seq,
+			}
+			if manualAck {
+				frame.AckToken, err = sealAckToken(msg, s.stationName, accountIdStr, s.userData.Username, time.Duration(reqBody.AckDeadlineMs)*time.Millisecond)
+				if err != nil {
+					s.log.Errorf("WebSocketHandleMessages - seal ack token: %s", err.Error())
+					continue // the message will be redelivered once its ack deadline has passed
+				}
+			}
+			if err := s.send(frame); err != nil {
+				return // client disconnected, the unacked message will be redelivered
+			}
+			if !manualAck {
+				if err := msg.Ack(); err != nil {
+					s.log.Errorf("WebSocketHandleMessages - acknowledge message: %s", err.Error())
+				}
+			}
+		}
+	})
+	if err != nil {
+		consumer.Destroy()
+		return nil, err
+	}
+	return consumer, nil
+}
+
+func WebSocketUpgrade(c *fiber.Ctx) error {
+	if websocket.IsWebSocketUpgrade(c) {
+		return c.Next()
+	}
+	return fiber.ErrUpgradeRequired
+}
+
+// WebSocketHandleMessages serves a bidirectional channel, every text/binary frame sent by the client is produced to the station
+// and answered with a produce_ack frame, consumed messages are pushed as message frames when a consumer name is given
+func WebSocketHandleMessages() func(*fiber.Ctx) error {
+	return websocket.New(func(ws *websocket.Conn) {
+		log, _ := ws.Locals("logger").(*logger.Logger)
+		userData, ok := ws.Locals("userData").(models.AuthSchema)
+		if !ok {
+			log.Errorf("WebSocketHandleMessages: failed to get the user data from the middleware")
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Server error"))
+			return
+		}
+		name, err := producerName(ws.Headers(producerNameHeader), ws.Query("producer_name"))
+		if err != nil {
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+			return
+		}
+		conn, release, err := getUserConnection(userData)
+		if err != nil {
+			if isAuthError(err) {
+				log.Warnf("Could not establish new connection with the broker: Authentication error")
+				ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Unauthorized"))
+				return
+			}
+			log.Errorf("Could not establish new connection with the broker: %s", err.Error())
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Server error"))
+			return
+		}
+		defer release()
+
+		stationName, _ := ws.Locals(stationNameLocal).(string)
+		session := &wsSession{
+			ws:           ws,
+			log:          log,
+			conn:         conn,
+			stationName:  stationName,
+			producerName: name,
+			userData:     userData,
+		}
+
+		done := make(chan struct{})
+		defer close(done)
+		consumerName := ws.Query("consumer_name")
+		manualAck := ws.Query("manual_ack") == "true"
+		if consumerName != "" {
+			reqBody := requestBody{ConsumerName: consumerName, ConsumerGroup: ws.Query("consumer_group"), ManualAck: manualAck, Encoding: ws.Query("encoding")}
+			if !isValidEncoding(reqBody.Encoding) {
+				ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Unsupported encoding, supported encodings are utf8, base64 and json"))
+				return
+			}
+			reqBody.BatchSize, _ = strconv.Atoi(ws.Query("batch_size"))
+			reqBody.AckDeadlineMs, _ = strconv.Atoi(ws.Query("ack_deadline_ms"))
+			consumer, err := session.consume(reqBody, manualAck, done)
+			if err != nil {
+				log.Errorf("WebSocketHandleMessages - consume: %s", err.Error())
+				session.writeLock.Lock()
+				ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()))
+				session.writeLock.Unlock()
+				return
+			}
+			defer func() {
+				if err := consumer.Destroy(); err != nil {
+					log.Errorf("WebSocketHandleMessages - destroy consumer: %s", err.Error())
+				}
+			}()
+		}
+
+		frameNum := 0
+		for {
+			msgType, data, err := ws.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.Warnf("WebSocketHandleMessages - read frame: %s", err.Error())
+				}
+				return
+			}
+			frameNum++
+			id := strconv.Itoa(frameNum)
+
+			if msgType == websocket.BinaryMessage {
+				session.produce(id, data, nil)
+				continue
+			}
+
+			var frame wsClientFrame
+			if err := json.Unmarshal(data, &frame); err != nil || frame.Action == "" {
+				session.produce(id, data, nil) // plain text frame
+				continue
+			}
+			if frame.Id == "" {
+				frame.Id = id
+			}
+			switch frame.Action {
+			case "produce":
+				message := []byte(frame.Message)
+				var text string
+				if err := json.Unmarshal(frame.Message, &text); err == nil {
+					message = []byte(text)
+				}
+				session.produce(frame.Id, message, frame.Headers)
+			case "ack", "nack":
+				session.settle(frame)
+			default:
+				session.result("error", frame.Id, errors.New("unsupported action "+frame.Action))
+			}
+		}
+	})
+}
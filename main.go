@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"rest-gateway/conf"
 	"rest-gateway/handlers"
 	"rest-gateway/logger"
+	"rest-gateway/middlewares"
 	"rest-gateway/router"
 	"time"
 )
@@ -38,13 +40,62 @@ func initializeLogger() *logger.Logger {
 func main() {
 	configuration := conf.GetConfig()
 	l := initializeLogger()
-	err := handlers.ListenForUpdates(l)
+	err := handlers.LoadJwtKeys()
+	if err != nil {
+		panic("Error while loading the jwt keys - " + err.Error())
+	}
+	err = handlers.LoadSignatureVerifiers()
+	if err != nil {
+		panic("Error while loading the signature verifiers - " + err.Error())
+	}
+	err = handlers.LoadOidcMappings()
+	if err != nil {
+		panic("Error while loading the oidc user mappings - " + err.Error())
+	}
+	err = handlers.ListenForUpdates(l)
 	if err != nil {
 		panic("Error while listening for updates - " + err.Error())
 	}
+	err = handlers.LoadApiKeys()
+	if err != nil {
+		l.Errorf("API keys are not available - %s", err.Error())
+	}
+	err = handlers.LoadRevocations()
+	if err != nil {
+		panic("Error while loading the revoked tokens - " + err.Error())
+	}
+	err = middlewares.StartRateLimitSync(l)
+	if err != nil {
+		l.Errorf("Rate limits will not be shared with the other gateways - %s", err.Error())
+	}
+	err = handlers.ListenForSubscriptions(l)
+	if err != nil {
+		l.Errorf("Webhook subscriptions are not available - %s", err.Error())
+	}
+	err = handlers.OpenOutbox(l)
+	if err != nil {
+		panic("Error while opening the outbox - " + err.Error())
+	}
+	handlers.StartAsyncProduceWorkers(l)
 	go handlers.CleanConnectionsCache()
+	go handlers.CleanIdleProducers()
+	go handlers.CleanReceipts()
+	go handlers.CleanRevokedTokens()
+	go handlers.CleanTokenFamilies()
+	tlsConfig, err := handlers.ServerTLSConfig()
+	if err != nil {
+		panic("Error while loading the https configuration - " + err.Error())
+	}
 	app := router.SetupRoutes(l)
 	l.Noticef("Memphis REST gateway is up and running")
 	l.Noticef("Version %s", configuration.VERSION)
+	if tlsConfig != nil {
+		ln, err := tls.Listen("tcp", ":"+configuration.HTTP_PORT, tlsConfig)
+		if err != nil {
+			panic("Error while listening for https requests - " + err.Error())
+		}
+		app.Listener(ln)
+		return
+	}
 	app.Listen(":" + configuration.HTTP_PORT)
 }
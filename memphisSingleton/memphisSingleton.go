@@ -3,8 +3,10 @@ package memphisSingleton
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"os"
 	"rest-gateway/conf"
+	"strconv"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -17,9 +19,13 @@ func GetMemphisConnection(hostname, creds, username string) (*nats.Conn, error)
 		configuration := conf.GetConfig()
 		var nc *nats.Conn
 		var err error
+		port := configuration.MEMPHIS_PORT
+		if port == 0 {
+			port = 6666
+		}
 
 		natsOpts := nats.Options{
-			Url:            hostname + ":6666",
+			Url:            hostname + ":" + strconv.Itoa(port),
 			AllowReconnect: true,
 			MaxReconnect:   10,
 			ReconnectWait:  3 * time.Second,
@@ -65,3 +71,20 @@ func GetMemphisConnection(hostname, creds, username string) (*nats.Conn, error)
 
 	return mc, nil
 }
+
+// GetKeyValueStore returns the key value bucket shared by all rest gateways, the bucket is created in case it does not exist
+func GetKeyValueStore(bucket string) (nats.KeyValue, error) {
+	nc, err := GetMemphisConnection("", "", "") // already initialized on logger creation
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket})
+	}
+	return kv, err
+}
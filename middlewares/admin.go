@@ -0,0 +1,19 @@
+package middlewares
+
+import (
+	"rest-gateway/models"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireAdmin only lets through requests made on behalf of the gateway's root user
+func RequireAdmin(c *fiber.Ctx) error {
+	userData, _ := c.Locals("userData").(models.AuthSchema)
+	if userData.Username == "" || !strings.EqualFold(userData.Username, configuration.ROOT_USER) || userData.AccountId != 1 || len(userData.Scopes) > 0 {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"message": "Forbidden",
+		})
+	}
+	return c.Next()
+}
@@ -11,15 +11,20 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/memphisdev/memphis.go"
 )
 
 var configuration = conf.GetConfig()
+
+const apiKeyHeader = "X-API-Key"
+
 var noNeedAuthRoutes = []string{
 	"/",
 	"/monitoring/status",
 	"/auth/authenticate",
 	"/auth/refreshtoken",
 	"/monitoring/getresourcesutilization",
+	"/.well-known/jwks.json",
 }
 
 func isAuthNeeded(path string) bool {
@@ -46,13 +51,17 @@ func extractToken(authHeader string) (string, error) {
 	return tokenString, nil
 }
 
-func verifyToken(tokenString string, secret string) (models.AuthSchema, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+func hmacKey(secret string) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		return []byte(secret), nil
-	})
+	}
+}
+
+func verifyToken(tokenString string, keyFunc jwt.Keyfunc) (models.AuthSchema, error) {
+	token, err := jwt.Parse(tokenString, keyFunc)
 	if err != nil {
 		return models.AuthSchema{}, errors.New("f")
 	}
@@ -64,21 +73,32 @@ func verifyToken(tokenString string, secret string) (models.AuthSchema, error) {
 
 	var user models.AuthSchema
 	if _, ok := claims["username"].(string); ok {
+		password, connectionToken, err := tokenCredentials(claims)
+		if err != nil {
+			return models.AuthSchema{}, err
+		}
 		if !configuration.USER_PASS_BASED_AUTH {
 			user = models.AuthSchema{
 				Username:        claims["username"].(string),
-				ConnectionToken: claims["connection_token"].(string),
+				ConnectionToken: connectionToken,
 				AccountId:       1,
-				TokenExpiry:     claims["exp"].(int64),
+				TokenExpiry:     int64(claims["exp"].(float64)),
+				Scopes:          tokenScopes(claims),
 			}
 		} else {
 			user = models.AuthSchema{
 				Username:    claims["username"].(string),
-				Password:    claims["password"].(string),
+				Password:    password,
 				AccountId:   claims["account_id"].(float64),
 				TokenExpiry: int64(claims["exp"].(float64)),
+				Scopes:      tokenScopes(claims),
 			}
 		}
+		user.TokenId, _ = claims["jti"].(string)
+		user.TokenFamilyId, _ = claims["fid"].(string)
+		iat, _ := claims["iat"].(float64)
+		user.TokenIssuedAt = int64(iat)
+		user.CredentialsExpiry = user.TokenExpiry
 	} else {
 		// for backward compatability
 		user = models.AuthSchema{
@@ -89,13 +109,47 @@ func verifyToken(tokenString string, secret string) (models.AuthSchema, error) {
 	return user, nil
 }
 
+func tokenCredentials(claims jwt.MapClaims) (string, string, error) {
+	if sealed, ok := claims["credentials"].(string); ok {
+		return handlers.OpenCredentials(sealed)
+	}
+	// tokens issued before the credentials were encrypted are accepted until they expire
+	password, _ := claims["password"].(string)
+	connectionToken, _ := claims["connection_token"].(string)
+	return password, connectionToken, nil
+}
+
+func tokenScopes(claims jwt.MapClaims) []string {
+	rawScopes, _ := claims["scopes"].([]interface{})
+	scopes := []string{}
+	for _, scope := range rawScopes {
+		if scope, ok := scope.(string); ok {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
 func Authenticate(c *fiber.Ctx) error {
+	if verified, _ := c.Locals("signatureVerified").(bool); verified {
+		return c.Next()
+	}
 	log := logger.GetLogger(c)
 	path := strings.ToLower(string(c.Context().URI().RequestURI()))
 	var user models.AuthSchema
 	var err error
 	path = strings.Split(path, "?")[0]
-	if isAuthNeeded(path) {
+	if apiKey := c.Get(apiKeyHeader); apiKey != "" && isAuthNeeded(path) {
+		user, err = handlers.VerifyApiKey(apiKey)
+		if err != nil {
+			log.Warnf("Authentication error - api key validation has failed")
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"message": "Unauthorized",
+			})
+		}
+	} else if certUser, ok := handlers.ClientCertUser(c.Context().TLSConnectionState()); ok && isAuthNeeded(path) && c.Get(fiber.HeaderAuthorization) == "" && c.Query("authorization") == "" {
+		user = certUser
+	} else if isAuthNeeded(path) {
 		headers := c.GetReqHeaders()
 		tokenString := ""
 		if len(headers["Authorization"]) == 0 {
@@ -113,8 +167,12 @@ func Authenticate(c *fiber.Ctx) error {
 				})
 			}
 		}
-		
-		user, err = verifyToken(tokenString, configuration.JWT_SECRET)
+
+		if handlers.IsOidcToken(tokenString) {
+			user, err = handlers.VerifyOidcToken(tokenString)
+		} else {
+			user, err = verifyToken(tokenString, handlers.AccessTokenKey)
+		}
 		if err != nil {
 			log.Warnf("Authentication error - jwt token validation has failed")
 			if configuration.DEBUG {
@@ -146,7 +204,7 @@ func Authenticate(c *fiber.Ctx) error {
 			})
 		}
 
-		user, err = verifyToken(body.JwtRefreshToken, configuration.REFRESH_JWT_SECRET)
+		user, err = verifyToken(body.JwtRefreshToken, hmacKey(configuration.REFRESH_JWT_SECRET))
 		if err != nil {
 			log.Warnf("Authentication error - refresh token validation has failed")
 			if configuration.DEBUG {
@@ -160,11 +218,21 @@ func Authenticate(c *fiber.Ctx) error {
 		user.AccountId = 1
 	}
 
+	// revocations apply whatever the user authenticated with, not only to the tokens issued by the gateways
+	if user.Username != "" && handlers.IsTokenRevoked(user) {
+		log.Warnf("Authentication error - the credentials of %s were revoked", user.Username)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"message": "Unauthorized",
+		})
+	}
+
 	// for backward compatability
 	if strings.HasSuffix(path, "/produce/single") || strings.HasSuffix(path, "/produce/batch") || path == "/auth/refreshtoken" {
 		if user.Username == "" {
 			accountId := 1
-			conn, err := handlers.Connect(configuration.ROOT_PASSWORD, configuration.ROOT_USER, configuration.CONNECTION_TOKEN, accountId)
+			_, err := handlers.Connections.GetOrConnect(handlers.ConnectionKey(accountId, configuration.ROOT_USER), int64(user.TokenExpiryMins), func() (*memphis.Conn, error) {
+				return handlers.Connect(configuration.ROOT_PASSWORD, configuration.ROOT_USER, configuration.CONNECTION_TOKEN, accountId)
+			})
 			if err != nil {
 				errMsg := strings.ToLower(err.Error())
 				if strings.Contains(errMsg, handlers.ErrorMsgAuthorizationViolation) || strings.Contains(errMsg, "token") || strings.Contains(errMsg, handlers.ErrorMsgMissionAccountId) {
@@ -174,13 +242,6 @@ func Authenticate(c *fiber.Ctx) error {
 					})
 				}
 			}
-			if handlers.ConnectionsCache["1"] == nil {
-				handlers.ConnectionsCacheLock.Lock()
-				handlers.ConnectionsCache["1"] = make(map[string]handlers.Connection)
-				handlers.ConnectionsCacheLock.Unlock()
-			}
-
-			handlers.ConnectionsCache["1"][configuration.ROOT_USER] = handlers.Connection{Connection: conn, ExpirationTime: int64(user.TokenExpiryMins)}
 
 			if !configuration.USER_PASS_BASED_AUTH {
 				user = models.AuthSchema{
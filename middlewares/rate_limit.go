@@ -0,0 +1,71 @@
+package middlewares
+
+import (
+	"fmt"
+	"math"
+	"rest-gateway/handlers"
+	"rest-gateway/logger"
+	"rest-gateway/memphisSingleton"
+	"rest-gateway/models"
+	"rest-gateway/ratelimit"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const rateLimitSyncInterval = time.Second
+
+var rateLimiter = ratelimit.New()
+
+func rateLimitRules(c *fiber.Ctx) []ratelimit.Rule {
+	rules := []ratelimit.Rule{{Key: "ip:" + c.IP(), PerMinute: configuration.RATE_LIMIT_IP_PER_MINUTE}}
+	userData, ok := c.Locals("userData").(models.AuthSchema)
+	if !ok || userData.Username == "" {
+		return rules
+	}
+
+	accountId := strconv.Itoa(int(userData.AccountId))
+	rules = append(rules,
+		ratelimit.Rule{Key: "account:" + accountId, PerMinute: configuration.RATE_LIMIT_ACCOUNT_PER_MINUTE},
+		ratelimit.Rule{Key: fmt.Sprintf("user:%s:%s", accountId, strings.ToLower(userData.Username)), PerMinute: configuration.RATE_LIMIT_USER_PER_MINUTE})
+	if stationName := handlers.StationName(c); stationName != "" {
+		rules = append(rules, ratelimit.Rule{Key: fmt.Sprintf("station:%s:%s", accountId, strings.ToLower(stationName)), PerMinute: configuration.RATE_LIMIT_STATION_PER_MINUTE})
+	}
+	return rules
+}
+
+// RateLimit enforces the request rate limits of the client ip, account, user and station
+func RateLimit(c *fiber.Ctx) error {
+	if strings.HasPrefix(c.Path(), "/monitoring") {
+		return c.Next()
+	}
+	res := rateLimiter.Allow(rateLimitRules(c))
+	if res.Limit == 0 { // no limits apply to the request
+		return c.Next()
+	}
+
+	reset := strconv.Itoa(int(math.Ceil(res.Reset.Seconds())))
+	c.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Set("RateLimit-Reset", reset)
+	if !res.Allowed {
+		c.Set(fiber.HeaderRetryAfter, reset)
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"message": "Too many requests",
+		})
+	}
+	return c.Next()
+}
+
+// StartRateLimitSync shares the rate limits usage with the other gateways
+func StartRateLimitSync(log *logger.Logger) error {
+	mc, err := memphisSingleton.GetMemphisConnection("", "", "") // already initialized on logger creation
+	if err != nil {
+		return err
+	}
+	return rateLimiter.StartSync(mc, configuration.RATE_LIMIT_SYNC_SUBJ, rateLimitSyncInterval, func(err error) {
+		log.Errorf("Rate limits sync: %s", err.Error())
+	})
+}
@@ -0,0 +1,43 @@
+package middlewares
+
+import (
+	"rest-gateway/handlers"
+	"rest-gateway/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireScope rejects requests whose token scopes don't allow the action on the station in the route
+func RequireScope(action string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userData, _ := c.Locals("userData").(models.AuthSchema)
+		stationName := handlers.StationName(c)
+		if !handlers.HasScope(userData, action, stationName) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"success": false,
+				"error":   handlers.ScopeError(action, stationName).Error(),
+			})
+		}
+		return c.Next()
+	}
+}
+
+// RequireWebSocketScopes rejects websocket upgrades whose token scopes don't allow producing to the station, every frame
+// the client sends is produced, or consuming from it when the session is opened with a consumer name
+func RequireWebSocketScopes(c *fiber.Ctx) error {
+	actions := []string{handlers.ScopeProduce}
+	if c.Query("consumer_name") != "" {
+		actions = append(actions, handlers.ScopeConsume)
+	}
+	userData, _ := c.Locals("userData").(models.AuthSchema)
+	stationName := handlers.StationName(c)
+	for _, action := range actions {
+		if !handlers.HasScope(userData, action, stationName) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"success": false,
+				"error":   handlers.ScopeError(action, stationName).Error(),
+			})
+		}
+	}
+	return c.Next()
+}
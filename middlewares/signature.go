@@ -0,0 +1,53 @@
+package middlewares
+
+import (
+	"rest-gateway/handlers"
+	"rest-gateway/logger"
+	"rest-gateway/models"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// VerifySignature authenticates signed webhooks producing to stations that have a signature verifier,
+// requests without the verifier's signature header are left to the token authentication
+func VerifySignature(c *fiber.Ctx) error {
+	path := strings.ToLower(c.Path())
+	if c.Method() != fiber.MethodPost || !strings.HasPrefix(path, "/stations/") || !strings.HasSuffix(path, "/produce/single") {
+		return c.Next()
+	}
+	if len(strings.Split(path, "/")) != 5 {
+		return c.Next()
+	}
+	header := func(key string) string { return c.Get(key) }
+	stationName := strings.ToLower(handlers.StationName(c))
+	verifiers := handlers.SignatureVerifiersFor(stationName, header)
+	if len(verifiers) == 0 {
+		return c.Next()
+	}
+
+	log := logger.GetLogger(c)
+	var user models.AuthSchema
+	var err error
+	for _, verifier := range verifiers {
+		user, err = handlers.VerifySignature(verifier, header, c.Body())
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Warnf("Authentication error - signature verification of station %s has failed: %s", stationName, err.Error())
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"message": "Unauthorized",
+		})
+	}
+	if handlers.IsTokenRevoked(user) {
+		log.Warnf("Authentication error - the credentials of %s were revoked", user.Username)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"message": "Unauthorized",
+		})
+	}
+	c.Locals("userData", user)
+	c.Locals("signatureVerified", true)
+	return c.Next()
+}
@@ -0,0 +1,25 @@
+package middlewares
+
+import (
+	"rest-gateway/handlers"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ResolveStationName resolves the station of /stations/<station name>/... requests once, from the raw request path,
+// for the signature verification, the rate limits, the scopes and the handlers
+func ResolveStationName(c *fiber.Ctx) error {
+	if !strings.HasPrefix(strings.ToLower(c.Path()), "/stations/") {
+		return c.Next()
+	}
+	stationName, err := handlers.ParseStationName(c.Path())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"success": false,
+			"error":   "Invalid station name",
+		})
+	}
+	handlers.SetStationName(c, strings.Clone(stationName))
+	return c.Next()
+}
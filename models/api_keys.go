@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+type CreateApiKeySchema struct {
+	Name             string   `json:"name"`
+	Username         string   `json:"username" validate:"required"`
+	Password         string   `json:"password"`
+	ConnectionToken  string   `json:"connection_token"`
+	AccountId        float64  `json:"account_id"`
+	Scopes           []string `json:"scopes"`
+	ExpiresInMinutes int      `json:"expires_in_minutes"`
+}
+
+type ApiKey struct {
+	Id          string     `json:"id"`
+	Name        string     `json:"name"`
+	Username    string     `json:"username"`
+	AccountId   float64    `json:"account_id"`
+	Scopes      []string   `json:"scopes"`
+	KeyHash     string     `json:"key_hash,omitempty"`
+	Credentials string     `json:"credentials,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
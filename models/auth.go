@@ -1,13 +1,18 @@
 package models
 
 type AuthSchema struct {
-	Username               string  `json:"username" validate:"required"`
-	ConnectionToken        string  `json:"connection_token"`
-	Password               string  `json:"password"`
-	TokenExpiryMins        int     `json:"token_expiry_in_minutes"`
-	RefreshTokenExpiryMins int     `json:"refresh_token_expiry_in_minutes"`
-	AccountId              float64 `json:"account_id"`
-	TokenExpiry            int64   `json:"token_expiry"`
+	Username               string   `json:"username" validate:"required"`
+	ConnectionToken        string   `json:"connection_token"`
+	Password               string   `json:"password"`
+	TokenExpiryMins        int      `json:"token_expiry_in_minutes"`
+	RefreshTokenExpiryMins int      `json:"refresh_token_expiry_in_minutes"`
+	AccountId              float64  `json:"account_id"`
+	TokenExpiry            int64    `json:"token_expiry"`
+	Scopes                 []string `json:"scopes"`
+	TokenId                string   `json:"-"`
+	TokenIssuedAt          int64    `json:"-"`
+	TokenFamilyId          string   `json:"-"`
+	CredentialsExpiry      int64    `json:"-"` // when the token, api key or client certificate expires, 0 if it does not
 }
 
 type RefreshTokenSchema struct {
@@ -15,3 +20,9 @@ type RefreshTokenSchema struct {
 	TokenExpiryMins        int    `json:"token_expiry_in_minutes"`
 	RefreshTokenExpiryMins int    `json:"refresh_token_expiry_in_minutes"`
 }
+
+type RevokeTokenSchema struct {
+	Token     string  `json:"token"`
+	Username  string  `json:"username"`
+	AccountId float64 `json:"account_id"`
+}
@@ -0,0 +1,12 @@
+package models
+
+// ClientCertMapping maps the client certificates matching the common name and/or SAN onto a Memphis user
+type ClientCertMapping struct {
+	CommonName      string   `json:"common_name"`
+	San             string   `json:"san"`
+	Username        string   `json:"username"`
+	Password        string   `json:"password"`
+	ConnectionToken string   `json:"connection_token"`
+	AccountId       float64  `json:"account_id"`
+	Scopes          []string `json:"scopes"`
+}
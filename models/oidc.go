@@ -0,0 +1,12 @@
+package models
+
+// OidcUserMapping maps the identities whose claim matches the value onto a Memphis service user
+type OidcUserMapping struct {
+	Claim           string   `json:"claim"`
+	Value           string   `json:"value"`
+	Username        string   `json:"username"`
+	Password        string   `json:"password"`
+	ConnectionToken string   `json:"connection_token"`
+	AccountId       float64  `json:"account_id"`
+	Scopes          []string `json:"scopes"`
+}
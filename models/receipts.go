@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type Receipt struct {
+	Id                     string     `json:"id"`
+	StationName            string     `json:"station_name"`
+	Status                 string     `json:"status"`
+	Messages               int        `json:"messages"`
+	Delivered              int        `json:"delivered"`
+	Failed                 int        `json:"failed"`
+	SchemaValidationFailed bool       `json:"schema_validation_failed"`
+	Errors                 []string   `json:"errors"`
+	Username               string     `json:"-"`
+	AccountId              float64    `json:"-"`
+	CreatedAt              time.Time  `json:"created_at"`
+	CompletedAt            *time.Time `json:"completed_at"`
+}
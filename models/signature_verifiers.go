@@ -0,0 +1,19 @@
+package models
+
+// SignatureVerifier authenticates the requests producing to a station by their signature instead of a token
+type SignatureVerifier struct {
+	Name             string  `json:"name"`
+	StationName      string  `json:"station_name"`
+	Scheme           string  `json:"scheme"` // github, stripe or hmac
+	Header           string  `json:"header"`
+	Algorithm        string  `json:"algorithm"` // sha1, sha256 or sha512
+	Encoding         string  `json:"encoding"`  // hex or base64
+	Prefix           string  `json:"prefix"`
+	Secret           string  `json:"secret"`
+	TimestampHeader  string  `json:"timestamp_header"`
+	ToleranceSeconds int     `json:"tolerance_seconds"`
+	Username         string  `json:"username"`
+	Password         string  `json:"password"`
+	ConnectionToken  string  `json:"connection_token"`
+	AccountId        float64 `json:"account_id"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+type CreateSubscriptionSchema struct {
+	StationName   string `json:"station_name" validate:"required"`
+	ConsumerGroup string `json:"consumer_group"`
+	TargetUrl     string `json:"target_url" validate:"required,url"`
+	BatchSize     int    `json:"batch_size"`
+	MaxRetries    int    `json:"max_retries"`
+	Secret        string `json:"secret"`
+	Encoding      string `json:"encoding"`
+}
+
+type Subscription struct {
+	Id            string    `json:"id"`
+	StationName   string    `json:"station_name"`
+	ConsumerGroup string    `json:"consumer_group"`
+	TargetUrl     string    `json:"target_url"`
+	BatchSize     int       `json:"batch_size"`
+	MaxRetries    int       `json:"max_retries"`
+	Encoding      string    `json:"encoding,omitempty"`
+	Secret        string    `json:"secret,omitempty"`
+	SealedSecret  string    `json:"sealed_secret,omitempty"`
+	Username      string    `json:"username"`
+	AccountId     float64   `json:"account_id"`
+	Credentials   string    `json:"credentials,omitempty"`
+	TokenId       string    `json:"token_id,omitempty"`
+	TokenFamilyId string    `json:"token_family_id,omitempty"`
+	TokenIssuedAt int64     `json:"token_issued_at,omitempty"`
+	ExpiresAt     int64     `json:"expires_at,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
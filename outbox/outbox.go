@@ -0,0 +1,483 @@
+// Package outbox is a disk-backed write-ahead queue, records are appended to segment files and read back in the order they were appended
+package outbox
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+
+	segmentExt       = ".seg"
+	cursorFileName   = "cursor"
+	recordHeaderSize = 8 // record length followed by its crc32
+)
+
+var (
+	ErrFull   = errors.New("the outbox is full")
+	ErrEmpty  = errors.New("the outbox is empty")
+	ErrClosed = errors.New("the outbox is closed")
+)
+
+type Options struct {
+	MaxBytes      int64   // total size of the segment files, 0 means unbounded
+	Budget        *Budget // size cap shared with other outboxes, checked on top of MaxBytes
+	SegmentBytes  int64   // size from which a new segment file is started
+	Fsync         string  // always, interval or never
+	FsyncInterval time.Duration
+}
+
+// Budget caps the total size of the segment files of several outboxes, it is safe for concurrent use
+type Budget struct {
+	lock     sync.Mutex
+	maxBytes int64
+	used     int64
+}
+
+// NewBudget returns a budget shared by the outboxes opened with it, 0 means unbounded
+func NewBudget(maxBytes int64) *Budget {
+	return &Budget{maxBytes: maxBytes}
+}
+
+// reserve takes size bytes from the budget, unless force is set it fails once the budget would be exceeded
+func (b *Budget) reserve(size int64, force bool) bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !force && b.maxBytes > 0 && b.used+size > b.maxBytes {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+func (b *Budget) release(size int64) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	b.used -= size
+	b.lock.Unlock()
+}
+
+// Used returns the size of the segment files of the open outboxes sharing the budget
+func (b *Budget) Used() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.used
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// Outbox is safe for concurrent use, records are committed one at a time by a single reader
+type Outbox struct {
+	lock       sync.Mutex
+	dir        string
+	opts       Options
+	segments   []*segment // oldest first, the last one is appended to
+	active     *os.File
+	dirty      bool
+	reader     *os.File // reads segments[0]
+	readOffset int64
+	pending    []byte
+	records    int
+	totalBytes int64
+	done       chan struct{}
+}
+
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Open opens the outbox stored in dir, records left over from a previous run are kept and a torn record
+// at the end of a segment (e.g. after a crash in the middle of a write) is truncated
+func Open(dir string, opts Options) (*Outbox, error) {
+	switch opts.Fsync {
+	case "":
+		opts.Fsync = FsyncInterval
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unsupported fsync policy %s, supported policies are always, interval and never", opts.Fsync)
+	}
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = time.Second
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = 64 << 20
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{dir: dir, opts: opts, done: make(chan struct{})}
+	cursorSeq, cursorOffset, err := o.readCursor()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq < cursorSeq { // fully replayed before the previous run stopped
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		o.segments = append(o.segments, &segment{seq: seq})
+	}
+	sort.Slice(o.segments, func(i, j int) bool { return o.segments[i].seq < o.segments[j].seq })
+
+	for i, seg := range o.segments {
+		from := int64(0)
+		if i == 0 && seg.seq == cursorSeq {
+			from = cursorOffset
+		}
+		size, records, err := scanSegment(segmentPath(dir, seg.seq), from)
+		if err != nil {
+			return nil, err
+		}
+		seg.size = size
+		o.records += records
+		o.totalBytes += size
+		if i == 0 {
+			o.readOffset = from
+			if from > size {
+				o.readOffset = size
+			}
+		}
+	}
+
+	if len(o.segments) == 0 { // the new segment follows the one pointed by the cursor so the cursor offset does not apply to it
+		o.segments = append(o.segments, &segment{seq: cursorSeq + 1})
+		o.readOffset = 0
+	}
+	last := o.segments[len(o.segments)-1]
+	o.active, err = os.OpenFile(segmentPath(dir, last.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	o.opts.Budget.reserve(o.totalBytes, true) // the records left over are kept even when they exceed the budget
+	if o.opts.Fsync == FsyncInterval {
+		go o.syncLoop()
+	}
+	return o, nil
+}
+
+// scanSegment validates the records of a segment file, truncates it after the last valid record
+// and returns its size and the number of records from the given offset
+func scanSegment(path string, from int64) (int64, int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	var offset int64
+	records := 0
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		data := make([]byte, length)
+		if _, err := io.ReadFull(f, data); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		if offset >= from {
+			records++
+		}
+		offset += recordHeaderSize + int64(length)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.Size() != offset {
+		if err := f.Truncate(offset); err != nil {
+			return 0, 0, err
+		}
+	}
+	return offset, records, nil
+}
+
+func (o *Outbox) readCursor() (uint64, int64, error) {
+	data, err := os.ReadFile(filepath.Join(o.dir, cursorFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var seq uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		return 0, 0, fmt.Errorf("invalid outbox cursor: %w", err)
+	}
+	return seq, offset, nil
+}
+
+// writeCursor persists the position of the next record to replay, it must be called while holding the lock
+func (o *Outbox) writeCursor() error {
+	tmp := filepath.Join(o.dir, cursorFileName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d %d", o.segments[0].seq, o.readOffset); err != nil {
+		f.Close()
+		return err
+	}
+	if o.opts.Fsync == FsyncAlways {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(o.dir, cursorFileName))
+}
+
+func (o *Outbox) syncLoop() {
+	ticker := time.NewTicker(o.opts.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+			o.lock.Lock()
+			if o.dirty && o.active != nil {
+				o.active.Sync()
+				o.dirty = false
+			}
+			o.lock.Unlock()
+		}
+	}
+}
+
+// roll starts a new segment file, it must be called while holding the lock
+func (o *Outbox) roll() error {
+	if err := o.active.Sync(); err != nil {
+		return err
+	}
+	if err := o.active.Close(); err != nil {
+		return err
+	}
+	o.dirty = false
+	seq := o.segments[len(o.segments)-1].seq + 1
+	f, err := os.OpenFile(segmentPath(o.dir, seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		o.active = nil
+		return err
+	}
+	if o.opts.Fsync == FsyncAlways {
+		syncDir(o.dir)
+	}
+	o.active = f
+	o.segments = append(o.segments, &segment{seq: seq})
+	return nil
+}
+
+// Append stores a record at the end of the outbox, ErrFull is returned once the size cap or the shared budget is reached
+func (o *Outbox) Append(record []byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.active == nil {
+		return ErrClosed
+	}
+	size := int64(recordHeaderSize + len(record))
+	if o.opts.MaxBytes > 0 && o.totalBytes+size > o.opts.MaxBytes {
+		return ErrFull
+	}
+	if !o.opts.Budget.reserve(size, false) {
+		return ErrFull
+	}
+	last := o.segments[len(o.segments)-1]
+	if last.size > 0 && last.size+size > o.opts.SegmentBytes {
+		if err := o.roll(); err != nil {
+			o.opts.Budget.release(size)
+			return err
+		}
+		last = o.segments[len(o.segments)-1]
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(record))
+	copy(buf[recordHeaderSize:], record)
+	if _, err := o.active.Write(buf); err != nil {
+		o.active.Truncate(last.size) // drop the partial record so the segment stays readable
+		o.opts.Budget.release(size)
+		return err
+	}
+	if o.opts.Fsync == FsyncAlways {
+		if err := o.active.Sync(); err != nil {
+			return err
+		}
+	} else {
+		o.dirty = true
+	}
+	last.size += size
+	o.totalBytes += size
+	o.records++
+	return nil
+}
+
+// Peek returns the oldest record without removing it, the same record is returned until it is committed
+func (o *Outbox) Peek() ([]byte, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.active == nil {
+		return nil, ErrClosed
+	}
+	if o.pending != nil {
+		return o.pending, nil
+	}
+	if o.records == 0 {
+		return nil, ErrEmpty
+	}
+	for o.readOffset >= o.segments[0].size && len(o.segments) > 1 {
+		if err := o.dropHead(); err != nil {
+			return nil, err
+		}
+	}
+	if o.reader == nil {
+		f, err := os.Open(segmentPath(o.dir, o.segments[0].seq))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(o.readOffset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		o.reader = f
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(o.reader, header); err != nil {
+		return nil, o.resetReader(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:4]))
+	if _, err := io.ReadFull(o.reader, data); err != nil {
+		return nil, o.resetReader(err)
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, o.resetReader(errors.New("corrupted outbox record"))
+	}
+	o.pending = data
+	return data, nil
+}
+
+// resetReader closes the reader so the next peek reads the record again from its offset
+func (o *Outbox) resetReader(err error) error {
+	o.reader.Close()
+	o.reader = nil
+	return err
+}
+
+// dropHead removes the oldest segment once all its records were committed, it must be called while holding the lock
+func (o *Outbox) dropHead() error {
+	head := o.segments[0]
+	if o.reader != nil {
+		o.reader.Close()
+		o.reader = nil
+	}
+	o.segments = o.segments[1:]
+	o.readOffset = 0
+	o.totalBytes -= head.size
+	o.opts.Budget.release(head.size)
+	if err := o.writeCursor(); err != nil {
+		return err
+	}
+	return os.Remove(segmentPath(o.dir, head.seq))
+}
+
+// Commit removes the record returned by the last Peek
+func (o *Outbox) Commit() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.pending == nil {
+		return nil
+	}
+	o.readOffset += int64(recordHeaderSize + len(o.pending))
+	o.pending = nil
+	o.records--
+	if o.readOffset >= o.segments[0].size {
+		if len(o.segments) == 1 && o.active != nil { // start a new segment so the replayed one can be removed
+			if err := o.roll(); err != nil {
+				return err
+			}
+		}
+		if len(o.segments) > 1 {
+			return o.dropHead()
+		}
+	}
+	return o.writeCursor()
+}
+
+// Depth returns the number of records waiting in the outbox and the size of their segment files
+func (o *Outbox) Depth() (int, int64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.records, o.totalBytes - o.readOffset
+}
+
+// Close gives the size of the remaining segment files back to the shared budget
+func (o *Outbox) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.active == nil {
+		return nil
+	}
+	close(o.done)
+	o.opts.Budget.release(o.totalBytes)
+	if o.reader != nil {
+		o.reader.Close()
+		o.reader = nil
+	}
+	err := o.active.Sync()
+	if closeErr := o.active.Close(); err == nil {
+		err = closeErr
+	}
+	o.active = nil
+	return err
+}
@@ -0,0 +1,286 @@
+package outbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openTest(t *testing.T, dir string, opts Options) *Outbox {
+	t.Helper()
+	o, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func appendRecords(t *testing.T, o *Outbox, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := o.Append([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+// expectRecords peeks and commits the records from..to-1 in order
+func expectRecords(t *testing.T, o *Outbox, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		record, err := o.Peek()
+		if err != nil {
+			t.Fatalf("Peek record %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("record-%d", i); string(record) != want {
+			t.Fatalf("expected %s, got %s", want, record)
+		}
+		if err := o.Commit(); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+	}
+	if _, err := o.Peek(); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected the outbox to be empty, got %v", err)
+	}
+}
+
+func TestPeekReturnsTheSameRecordUntilCommitted(t *testing.T) {
+	o := openTest(t, t.TempDir(), Options{Fsync: FsyncAlways})
+	appendRecords(t, o, 0, 2)
+	for i := 0; i < 3; i++ {
+		record, err := o.Peek()
+		if err != nil || string(record) != "record-0" {
+			t.Fatalf("expected record-0, got %s, %v", record, err)
+		}
+	}
+	expectRecords(t, o, 0, 2)
+}
+
+func TestRestartRecovery(t *testing.T) {
+	dir := t.TempDir()
+	o, err := Open(dir, Options{Fsync: FsyncAlways, SegmentBytes: 64})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendRecords(t, o, 0, 10)
+	for i := 0; i < 4; i++ {
+		if _, err := o.Peek(); err != nil {
+			t.Fatalf("Peek: %v", err)
+		}
+		if err := o.Commit(); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+	}
+	if _, err := o.Peek(); err != nil { // peeked but not committed, it is replayed again after the restart
+		t.Fatalf("Peek: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	o = openTest(t, dir, Options{Fsync: FsyncAlways, SegmentBytes: 64})
+	if records, _ := o.Depth(); records != 6 {
+		t.Fatalf("expected 6 records after the restart, got %d", records)
+	}
+	appendRecords(t, o, 10, 12)
+	expectRecords(t, o, 4, 12)
+}
+
+func TestRestartRemovesReplayedSegments(t *testing.T) {
+	dir := t.TempDir()
+	o, err := Open(dir, Options{Fsync: FsyncAlways, SegmentBytes: 32})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendRecords(t, o, 0, 6)
+	for i := 0; i < 6; i++ {
+		o.Peek()
+		o.Commit()
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	o = openTest(t, dir, Options{Fsync: FsyncAlways, SegmentBytes: 32})
+	if records, size := o.Depth(); records != 0 || size != 0 {
+		t.Fatalf("expected an empty outbox, got %d records and %d bytes", records, size)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segments) != 1 {
+		t.Fatalf("expected only the active segment to be left, got %v", segments)
+	}
+}
+
+func TestTornWriteIsTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		torn func(record []byte) []byte
+	}{
+		{"partial header", func(record []byte) []byte { return record[:recordHeaderSize-3] }},
+		{"partial data", func(record []byte) []byte { return record[:len(record)-2] }},
+		{"bad checksum", func(record []byte) []byte {
+			corrupted := bytes.Clone(record)
+			corrupted[len(corrupted)-1] ^= 0xff
+			return corrupted
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			o, err := Open(dir, Options{Fsync: FsyncAlways})
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			appendRecords(t, o, 0, 3)
+			seq := o.segments[len(o.segments)-1].seq
+			validSize := o.segments[len(o.segments)-1].size
+			if err := o.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			// simulate a crash in the middle of appending a fourth record
+			path := segmentPath(dir, seq)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			last := data[validSize-int64(recordHeaderSize+len("record-2")):]
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				t.Fatalf("OpenFile: %v", err)
+			}
+			f.Write(tt.torn(last))
+			f.Close()
+
+			o = openTest(t, dir, Options{Fsync: FsyncAlways})
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if info.Size() != validSize {
+				t.Fatalf("expected the segment to be truncated to %d bytes, got %d", validSize, info.Size())
+			}
+			if records, _ := o.Depth(); records != 3 {
+				t.Fatalf("expected 3 records, got %d", records)
+			}
+			appendRecords(t, o, 3, 4) // appended right after the last valid record
+			expectRecords(t, o, 0, 4)
+		})
+	}
+}
+
+func TestInvalidCursor(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, cursorFileName), []byte("garbage"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := Open(dir, Options{}); err == nil {
+		t.Fatal("expected an invalid cursor to fail opening the outbox")
+	}
+}
+
+func TestAppendRejectedOnceFull(t *testing.T) {
+	o := openTest(t, t.TempDir(), Options{Fsync: FsyncNever, MaxBytes: 3 * (recordHeaderSize + int64(len("record-0")))})
+	appendRecords(t, o, 0, 3)
+	if err := o.Append([]byte("record-3")); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+}
+
+func TestConcurrentAppendAndReplay(t *testing.T) {
+	o := openTest(t, t.TempDir(), Options{Fsync: FsyncInterval, SegmentBytes: 256})
+	const records = 500
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < records; i++ {
+			if err := o.Append([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+				t.Errorf("Append: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < records; {
+		record, err := o.Peek()
+		if errors.Is(err, ErrEmpty) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Peek: %v", err)
+		}
+		if want := fmt.Sprintf("record-%d", i); string(record) != want {
+			t.Fatalf("expected %s, got %s", want, record)
+		}
+		if err := o.Commit(); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+		i++
+	}
+	wg.Wait()
+}
+
+func TestClosed(t *testing.T) {
+	o, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	o.Close()
+	if err := o.Append([]byte("record")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := o.Peek(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestBudgetSharedBetweenOutboxes(t *testing.T) {
+	recordSize := recordHeaderSize + int64(len("record-0"))
+	budget := NewBudget(3 * recordSize)
+	first := openTest(t, t.TempDir(), Options{Fsync: FsyncNever, Budget: budget})
+	second := openTest(t, t.TempDir(), Options{Fsync: FsyncNever, Budget: budget})
+	appendRecords(t, first, 0, 2)
+	appendRecords(t, second, 0, 1)
+	if err := second.Append([]byte("record-1")); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull once the shared budget is used, got %v", err)
+	}
+
+	expectRecords(t, first, 0, 2) // committing rolls the segment so its size goes back to the budget
+	if used := budget.Used(); used != recordSize {
+		t.Fatalf("expected %d bytes of the budget to be used, got %d", recordSize, used)
+	}
+	appendRecords(t, second, 1, 3)
+}
+
+func TestBudgetCountsLeftOverRecords(t *testing.T) {
+	dir := t.TempDir()
+	o, err := Open(dir, Options{Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendRecords(t, o, 0, 3)
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	recordSize := recordHeaderSize + int64(len("record-0"))
+	budget := NewBudget(3 * recordSize)
+	o = openTest(t, dir, Options{Fsync: FsyncAlways, Budget: budget})
+	if used := budget.Used(); used != 3*recordSize {
+		t.Fatalf("expected the left over records to use %d bytes of the budget, got %d", 3*recordSize, used)
+	}
+	if err := o.Append([]byte("record-3")); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if used := budget.Used(); used != 0 {
+		t.Fatalf("expected closing the outbox to release the budget, got %d bytes used", used)
+	}
+}
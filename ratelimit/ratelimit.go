@@ -0,0 +1,186 @@
+// Package ratelimit implements token bucket rate limits that are shared between the gateway replicas
+package ratelimit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const idleBucketTimeout = 10 * time.Minute
+
+var clock = time.Now // overridden by the tests
+
+// Rule limits the requests counted under the key, a bucket holds up to PerMinute tokens and is refilled continuously
+type Rule struct {
+	Key       string
+	PerMinute int
+}
+
+// Result describes the most restrictive of the rules checked for a request
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration // until the bucket is full again, or until the next token when the request is denied
+}
+
+type bucket struct {
+	tokens   float64
+	limit    float64
+	updated  time.Time
+	lastUsed time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.tokens = math.Min(b.limit, b.tokens+elapsed*b.limit/60)
+	b.updated = now
+}
+
+type syncMessage struct {
+	InstanceId string                 `json:"instance_id"`
+	Consumed   map[string]syncedUsage `json:"consumed"`
+}
+
+type syncedUsage struct {
+	Tokens    float64 `json:"tokens"`
+	PerMinute int     `json:"per_minute"`
+}
+
+// Limiter keeps the buckets locally and periodically exchanges the tokens consumed by every replica,
+// so a replica may briefly let through more requests than the limit before the others' usage arrives
+type Limiter struct {
+	lock       sync.Mutex
+	buckets    map[string]*bucket
+	consumed   map[string]syncedUsage // since the last sync
+	instanceId string
+}
+
+func New() *Limiter {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Limiter{
+		buckets:    map[string]*bucket{},
+		consumed:   map[string]syncedUsage{},
+		instanceId: hex.EncodeToString(id),
+	}
+}
+
+func (l *Limiter) bucket(rule Rule, now time.Time) *bucket {
+	b, ok := l.buckets[rule.Key]
+	if !ok || b.limit != float64(rule.PerMinute) {
+		b = &bucket{tokens: float64(rule.PerMinute), limit: float64(rule.PerMinute), updated: now}
+		l.buckets[rule.Key] = b
+	}
+	b.refill(now)
+	b.lastUsed = now
+	return b
+}
+
+// Allow takes a token from every rule's bucket, nothing is taken unless all the buckets have a token
+func (l *Limiter) Allow(rules []Rule) Result {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := clock()
+	res := Result{Allowed: true}
+	limited := make([]Rule, 0, len(rules))
+	buckets := make([]*bucket, 0, len(rules))
+	for _, rule := range rules {
+		if rule.PerMinute <= 0 {
+			continue
+		}
+		b := l.bucket(rule, now)
+		limited = append(limited, rule)
+		buckets = append(buckets, b)
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) * 60 / b.limit * float64(time.Second))
+			if res.Allowed || wait > res.Reset {
+				res = Result{Allowed: false, Limit: rule.PerMinute, Remaining: 0, Reset: wait}
+			}
+		}
+	}
+	if !res.Allowed || len(limited) == 0 {
+		return res
+	}
+
+	res.Remaining = math.MaxInt
+	for i, rule := range limited {
+		b := buckets[i]
+		b.tokens--
+		usage := l.consumed[rule.Key]
+		usage.Tokens++
+		usage.PerMinute = rule.PerMinute
+		l.consumed[rule.Key] = usage
+		if remaining := int(b.tokens); remaining < res.Remaining {
+			res.Limit = rule.PerMinute
+			res.Remaining = remaining
+			res.Reset = time.Duration((b.limit - b.tokens) * 60 / b.limit * float64(time.Second))
+		}
+	}
+	return res
+}
+
+func (l *Limiter) applyRemote(msg syncMessage) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := clock()
+	for key, usage := range msg.Consumed {
+		b := l.bucket(Rule{Key: key, PerMinute: usage.PerMinute}, now)
+		b.tokens -= usage.Tokens // may go negative, the bucket then refills before letting requests through
+	}
+}
+
+func (l *Limiter) takeConsumed() map[string]syncedUsage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	consumed := l.consumed
+	l.consumed = map[string]syncedUsage{}
+
+	now := clock()
+	for key, b := range l.buckets {
+		if now.Sub(b.lastUsed) > idleBucketTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	return consumed
+}
+
+// StartSync publishes the tokens consumed by this replica on the subject every interval and applies the ones consumed by the others
+func (l *Limiter) StartSync(nc *nats.Conn, subject string, interval time.Duration, onError func(error)) error {
+	_, err := nc.Subscribe(subject, func(natsMsg *nats.Msg) {
+		var msg syncMessage
+		if err := json.Unmarshal(natsMsg.Data, &msg); err != nil {
+			onError(err)
+			return
+		}
+		if msg.InstanceId != l.instanceId {
+			l.applyRemote(msg)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			consumed := l.takeConsumed()
+			if len(consumed) == 0 {
+				continue
+			}
+			msg, err := json.Marshal(syncMessage{InstanceId: l.instanceId, Consumed: consumed})
+			if err == nil {
+				err = nc.Publish(subject, msg)
+			}
+			if err != nil {
+				onError(err)
+			}
+		}
+	}()
+	return nil
+}
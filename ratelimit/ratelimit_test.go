@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock makes the buckets refill only when the test advances the time
+func fakeClock(t *testing.T) func(time.Duration) {
+	t.Helper()
+	current := time.Unix(1700000000, 0)
+	clock = func() time.Time { return current }
+	t.Cleanup(func() { clock = time.Now })
+	return func(d time.Duration) { current = current.Add(d) }
+}
+
+func allowN(l *Limiter, rules []Rule, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if l.Allow(rules).Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestBurstUpToTheLimit(t *testing.T) {
+	fakeClock(t)
+	l := New()
+	rules := []Rule{{Key: "user", PerMinute: 5}}
+	for i := 4; i >= 0; i-- {
+		res := l.Allow(rules)
+		if !res.Allowed || res.Limit != 5 || res.Remaining != i {
+			t.Fatalf("expected the request to be allowed with %d remaining, got %+v", i, res)
+		}
+	}
+	res := l.Allow(rules)
+	if res.Allowed || res.Remaining != 0 {
+		t.Fatalf("expected the request over the burst to be denied, got %+v", res)
+	}
+	if res.Reset != 12*time.Second {
+		t.Fatalf("expected the next token in 12s, got %s", res.Reset)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	advance := fakeClock(t)
+	l := New()
+	rules := []Rule{{Key: "user", PerMinute: 60}}
+	if allowed := allowN(l, rules, 100); allowed != 60 {
+		t.Fatalf("expected a burst of 60 requests, got %d", allowed)
+	}
+
+	advance(5 * time.Second)
+	if allowed := allowN(l, rules, 100); allowed != 5 {
+		t.Fatalf("expected 5 requests after 5 seconds, got %d", allowed)
+	}
+
+	advance(10 * time.Minute) // the bucket never holds more than the limit
+	if allowed := allowN(l, rules, 100); allowed != 60 {
+		t.Fatalf("expected a full bucket of 60 requests, got %d", allowed)
+	}
+}
+
+func TestMostRestrictiveRule(t *testing.T) {
+	fakeClock(t)
+	l := New()
+	rules := []Rule{{Key: "account", PerMinute: 100}, {Key: "station", PerMinute: 2}, {Key: "ip", PerMinute: 0}}
+	res := l.Allow(rules)
+	if !res.Allowed || res.Limit != 2 || res.Remaining != 1 {
+		t.Fatalf("expected the station limit to be reported, got %+v", res)
+	}
+	l.Allow(rules)
+	if res := l.Allow(rules); res.Allowed || res.Limit != 2 {
+		t.Fatalf("expected the station limit to deny the request, got %+v", res)
+	}
+	// a denied request takes no token from the other buckets
+	if res := l.Allow([]Rule{{Key: "account", PerMinute: 100}}); res.Remaining != 97 {
+		t.Fatalf("expected 97 requests left on the account, got %+v", res)
+	}
+}
+
+func TestRemoteUsageIsMerged(t *testing.T) {
+	advance := fakeClock(t)
+	l := New()
+	rules := []Rule{{Key: "user", PerMinute: 60}}
+	l.Allow(rules)
+	l.applyRemote(syncMessage{InstanceId: "other", Consumed: map[string]syncedUsage{"user": {Tokens: 50, PerMinute: 60}}})
+	if allowed := allowN(l, rules, 100); allowed != 9 {
+		t.Fatalf("expected 9 requests left after the other replica's usage, got %d", allowed)
+	}
+
+	// usage reported past the bucket's tokens leaves it in debt until it refills
+	l.applyRemote(syncMessage{InstanceId: "other", Consumed: map[string]syncedUsage{"user": {Tokens: 30, PerMinute: 60}}})
+	advance(20 * time.Second)
+	if res := l.Allow(rules); res.Allowed {
+		t.Fatalf("expected the request to be denied while the bucket is in debt, got %+v", res)
+	}
+	advance(11 * time.Second)
+	if res := l.Allow(rules); !res.Allowed {
+		t.Fatalf("expected the request to be allowed once the bucket refilled, got %+v", res)
+	}
+}
+
+func TestConsumedUsageIsReportedOnce(t *testing.T) {
+	advance := fakeClock(t)
+	l := New()
+	allowN(l, []Rule{{Key: "user", PerMinute: 10}, {Key: "station", PerMinute: 5}}, 3)
+	consumed := l.takeConsumed()
+	if consumed["user"] != (syncedUsage{Tokens: 3, PerMinute: 10}) || consumed["station"] != (syncedUsage{Tokens: 3, PerMinute: 5}) {
+		t.Fatalf("unexpected consumed usage %+v", consumed)
+	}
+	if consumed := l.takeConsumed(); len(consumed) != 0 {
+		t.Fatalf("expected the usage to be reported once, got %+v", consumed)
+	}
+
+	advance(idleBucketTimeout + time.Second)
+	l.takeConsumed()
+	if len(l.buckets) != 0 {
+		t.Fatalf("expected the idle buckets to be dropped, got %d", len(l.buckets))
+	}
+}
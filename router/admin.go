@@ -0,0 +1,17 @@
+package router
+
+import (
+	"rest-gateway/handlers"
+	"rest-gateway/middlewares"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+)
+
+func InitializeAdminRoutes(app *fiber.App) {
+	apiKeysHandler := handlers.ApiKeysHandler{}
+	api := app.Group("/admin", logger.New(), middlewares.RequireAdmin)
+	api.Post("/apiKeys", apiKeysHandler.CreateApiKey)
+	api.Get("/apiKeys", apiKeysHandler.ListApiKeys)
+	api.Delete("/apiKeys/:id", apiKeysHandler.RevokeApiKey)
+}
@@ -2,6 +2,7 @@ package router
 
 import (
 	"rest-gateway/handlers"
+	"rest-gateway/middlewares"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -12,4 +13,7 @@ func InitilizeAuthRoutes(app *fiber.App) {
 	api := app.Group("/auth", logger.New())
 	api.Post("/authenticate", authHandler.Authenticate)
 	api.Post("/refreshToken", authHandler.RefreshToken)
+	api.Post("/logout", authHandler.Logout)
+	api.Post("/revoke", middlewares.RequireAdmin, authHandler.RevokeToken)
+	app.Get("/.well-known/jwks.json", authHandler.Jwks)
 }
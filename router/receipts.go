@@ -0,0 +1,14 @@
+package router
+
+import (
+	"rest-gateway/handlers"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+)
+
+func InitializeReceiptsRoutes(app *fiber.App) {
+	receiptsHandler := handlers.ReceiptsHandler{}
+	api := app.Group("/receipts", logger.New())
+	api.Get("/:id", receiptsHandler.GetReceipt)
+}
@@ -18,10 +18,16 @@ func SetupRoutes(l *logger.Logger) *fiber.App {
 
 	logger.SetLogger(app, l)
 	app.Use(cors.New())
+	app.Use(middlewares.ResolveStationName)
+	app.Use(middlewares.VerifySignature)
 	app.Use(middlewares.Authenticate)
+	app.Use(middlewares.RateLimit)
 
 	InitilizeAuthRoutes(app)
 	InitializeStationsRoutes(app)
+	InitializeSubscriptionsRoutes(app)
+	InitializeReceiptsRoutes(app)
+	InitializeAdminRoutes(app)
 	InitilizeMonitoringRoutes(app)
 	return app
 }
@@ -2,6 +2,7 @@ package router
 
 import (
 	"rest-gateway/handlers"
+	"rest-gateway/middlewares"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -9,7 +10,11 @@ import (
 
 func InitializeStationsRoutes(app *fiber.App) {
 	api := app.Group("/stations", logger.New())
-	api.Post("/:stationName/produce/single", handlers.CreateHandleMessage())
-	api.Post("/:stationName/produce/batch", handlers.CreateHandleBatch())
-	api.Post("/:stationName/consume/batch", handlers.ConsumeHandleMessage())
+	api.Post("/:stationName/produce/single", middlewares.RequireScope(handlers.ScopeProduce), handlers.CreateHandleMessage())
+	api.Post("/:stationName/produce/batch", middlewares.RequireScope(handlers.ScopeProduce), handlers.CreateHandleBatch())
+	api.Post("/:stationName/consume/batch", middlewares.RequireScope(handlers.ScopeConsume), handlers.ConsumeHandleMessage())
+	api.Get("/:stationName/consume/stream", middlewares.RequireScope(handlers.ScopeConsume), handlers.ConsumeStreamHandleMessages())
+	api.Post("/:stationName/ack", middlewares.RequireScope(handlers.ScopeConsume), handlers.AckHandleMessages())
+	api.Post("/:stationName/nack", middlewares.RequireScope(handlers.ScopeConsume), handlers.NackHandleMessages())
+	api.Get("/:stationName/ws", handlers.WebSocketUpgrade, middlewares.RequireWebSocketScopes, handlers.WebSocketHandleMessages())
 }
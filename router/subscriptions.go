@@ -0,0 +1,16 @@
+package router
+
+import (
+	"rest-gateway/handlers"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+)
+
+func InitializeSubscriptionsRoutes(app *fiber.App) {
+	subscriptionsHandler := handlers.SubscriptionsHandler{}
+	api := app.Group("/subscriptions", logger.New())
+	api.Post("/", subscriptionsHandler.CreateSubscription)
+	api.Get("/", subscriptionsHandler.ListSubscriptions)
+	api.Delete("/:id", subscriptionsHandler.DeleteSubscription)
+}
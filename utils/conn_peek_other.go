@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package utils
+
+import "net"
+
+// IsConnClosed is not supported on this platform, connections are always reported as open
+func IsConnClosed(conn net.Conn) bool {
+	return false
+}